@@ -1,26 +1,35 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	comatproto "github.com/bluesky-social/indigo/api/atproto"
-	"github.com/bluesky-social/indigo/repo"
-	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/ipfs/go-cid"
+	"github.com/stanfordio/skyfall/pkg/archive"
 	"github.com/stanfordio/skyfall/pkg/auth"
+	"github.com/stanfordio/skyfall/pkg/breaker"
+	"github.com/stanfordio/skyfall/pkg/carfiles"
 	"github.com/stanfordio/skyfall/pkg/census"
+	"github.com/stanfordio/skyfall/pkg/config"
+	"github.com/stanfordio/skyfall/pkg/hostlimit"
 	"github.com/stanfordio/skyfall/pkg/hydrator"
+	"github.com/stanfordio/skyfall/pkg/labels"
+	"github.com/stanfordio/skyfall/pkg/metrics"
 	"github.com/stanfordio/skyfall/pkg/output"
+	"github.com/stanfordio/skyfall/pkg/output/dedup"
 	pull "github.com/stanfordio/skyfall/pkg/pull"
+	"github.com/stanfordio/skyfall/pkg/shard"
 	stream "github.com/stanfordio/skyfall/pkg/stream"
 	"github.com/stanfordio/skyfall/pkg/utils"
 	"github.com/urfave/cli/v2"
@@ -33,14 +42,12 @@ func main() {
 }
 
 func run(args []string) {
-
-	logLevel, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
-	if err != nil {
-		logLevel = log.InfoLevel
+	if err := newApp().Run(args); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	log.SetLevel(logLevel)
-
+func newApp() *cli.App {
 	app := &cli.App{
 		Name:    "skyfall",
 		Usage:   "A simple CLI for Bluesky data ingest",
@@ -50,7 +57,7 @@ func run(args []string) {
 				Name:   "stream",
 				Usage:  "Sip from the firehose",
 				Action: streamCmd,
-				Flags: []cli.Flag{
+				Flags: flags([]cli.Flag{
 					&cli.IntFlag{
 						Name:  "worker-count",
 						Usage: "number of workers to scale to",
@@ -80,6 +87,165 @@ func run(args []string) {
 						Usage: "automatically restart the stream if it dies",
 						Value: true,
 					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "verify each commit's signature and MST proofs, recording the result in the Verified field",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "shard",
+						Usage: "hydrate and write only this instance's share of the firehose, as N/M (the Nth of M instances, by a hash of each commit's actor DID); each shard backfills from its own rows (if unspecified, every commit is handled)",
+					},
+				}, hydrationFlags(), dedupFlags()),
+			},
+			{
+				Name:   "record",
+				Usage:  "Record raw firehose frames to compressed segment files, without any hydration (replay them later with the replay command)",
+				Action: recordCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output-dir",
+						Usage: "directory to write segments to (if it already has segments, will attempt to backfill from the most recent one)",
+						Value: "firehose",
+					},
+					&cli.Int64Flag{
+						Name:  "segment-size",
+						Usage: "uncompressed bytes to write to a segment before starting a new one",
+						Value: 1 << 30,
+					},
+					&cli.DurationFlag{
+						Name:  "segment-duration",
+						Usage: "how long to write to a segment before starting a new one",
+						Value: time.Hour,
+					},
+					&cli.Int64Flag{
+						Name:  "backfill-seq",
+						Usage: "seq to backfill from (if specified, will override the seqno extracted from the most recent segment)",
+						Value: 0,
+					},
+					&cli.BoolFlag{
+						Name:  "autorestart",
+						Usage: "automatically restart the recording if it dies",
+						Value: true,
+					},
+				},
+			},
+			{
+				Name:   "replay",
+				Usage:  "Replay recorded firehose frames through the stream pipeline (hydration and output), as if they were live",
+				Action: replayCmd,
+				Flags: flags([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "input-dir",
+						Usage: "directory of segments written by the record command",
+						Value: "firehose",
+					},
+					&cli.Int64Flag{
+						Name:  "from-seq",
+						Usage: "first seq to replay",
+						Value: 0,
+					},
+					&cli.Int64Flag{
+						Name:  "to-seq",
+						Usage: "last seq to replay (if zero, replays everything)",
+						Value: 0,
+					},
+					&cli.Float64Flag{
+						Name:  "speed",
+						Usage: "multiple of real time to replay at, e.g., 1 for the original pace or 10 for ten times faster (if zero, replays as fast as possible)",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "output-file",
+						Usage: "file to write output to",
+						Value: "output.jsonl",
+					},
+					&cli.BoolFlag{
+						Name:  "stringify-full",
+						Usage: "whether to stringify the full event in file output (if true, the JSON will be stringified; this is helpful when you want output to match what would be sent to BigQuery)",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "output-bq-table",
+						Usage: "name of a BigQuery table to output to in ID form (e.g., dgap_bsky.example_table)",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "verify each commit's signature and MST proofs, recording the result in the Verified field",
+						Value: false,
+					},
+				}, hydrationFlags(), dedupFlags()),
+			},
+			{
+				Name:   "labels",
+				Usage:  "Subscribe to the label streams of one or more labelers (e.g., moderation services); does not require any authentication!",
+				Action: labelsCmd,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "labeler",
+						Usage:    "DID or handle of a labeler to subscribe to (may be repeated)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "output-file",
+						Usage: "file to write output to",
+						Value: "labels.jsonl",
+					},
+					&cli.BoolFlag{
+						Name:  "stringify-full",
+						Usage: "whether to stringify the full event in file output (if true, the JSON will be stringified; this is helpful when you want output to match what would be sent to BigQuery)",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "output-bq-table",
+						Usage: "name of a BigQuery table to output to in ID form (e.g., dgap_bsky.example_table)",
+					},
+					&cli.StringFlag{
+						Name:  "cursor-state",
+						Usage: "file to store each labeler's cursor in, so that the stream can backfill after a restart",
+						Value: "labels-cursors.json",
+					},
+					&cli.Int64Flag{
+						Name:  "backfill-seq",
+						Usage: "seq to backfill from (only allowed with a single labeler; if specified, will override the cursor state file)",
+						Value: 0,
+					},
+					&cli.BoolFlag{
+						Name:  "autorestart",
+						Usage: "automatically reconnect to a labeler if its stream dies",
+						Value: true,
+					},
+				},
+			},
+			{
+				Name:   "identity-history",
+				Usage:  "Pull the identity history (handle changes, PDS migrations and key rotations) of every did:plc account in a census file from the PLC audit log; does not require any authentication!",
+				Action: identityHistoryCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "census-file",
+						Usage: "file with census data (see the `census` command)",
+						Value: "census.jsonl",
+					},
+					&cli.IntFlag{
+						Name:  "worker-count",
+						Usage: "number of workers to scale to",
+						Value: 32,
+					},
+					&cli.StringFlag{
+						Name:  "output-file",
+						Usage: "file to write output to",
+						Value: "identity-history.jsonl",
+					},
+					&cli.BoolFlag{
+						Name:  "stringify-full",
+						Usage: "whether to stringify the full event in file output (if true, the JSON will be stringified; this is helpful when you want output to match what would be sent to BigQuery)",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "output-bq-table",
+						Usage: "name of a BigQuery table to output to in ID form (e.g., dgap_bsky.example_table)",
+					},
 				},
 			},
 			{
@@ -87,10 +253,10 @@ func run(args []string) {
 				Usage:  "Pull all DIDs from the network, likely so that you can later pull them; does not require any authentication!",
 				Action: censusCmd,
 				Flags: []cli.Flag{
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:  "pds-endpoint",
-						Usage: "PDS endpoint to pull from; if you use bsky's PDS 'aggregator' (the default), we find empirically you'll get most (all?) accounts",
-						Value: "https://bsky.network",
+						Usage: "PDS endpoint to pull from; if you use bsky's PDS 'aggregator' (the default), we find empirically you'll get most (all?) accounts; may be repeated to also list self-hosted PDSes",
+						Value: cli.NewStringSlice("https://bsky.network"),
 					},
 					&cli.StringFlag{
 						Name:  "output-file",
@@ -103,7 +269,7 @@ func run(args []string) {
 				Name:   "pull",
 				Usage:  "Pull all content and write it to a file or BigQuery",
 				Action: pullCmd,
-				Flags: []cli.Flag{
+				Flags: flags([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "census-file",
 						Usage: "file with census data (see the `census` command); census data is a list of DIDs to pull; the command assumes that this list does not change in any way over the course of the pull",
@@ -138,13 +304,35 @@ func run(args []string) {
 						Name:  "output-bq-table",
 						Usage: "name of a BigQuery table to output to in ID form (e.g., dgap_bsky.example_table)",
 					},
-				},
+					&cli.StringFlag{
+						Name:  "serve-leases",
+						Usage: "address to coordinate a distributed pull on, e.g., :8700: rather than pulling anything itself, the coordinator splits --census-file into ranges and leases them to workers (see --coordinator), keeping track of finished ranges in --intermediate-state",
+					},
+					&cli.StringFlag{
+						Name:  "coordinator",
+						Usage: "URL of a coordinator (see --serve-leases) to work for, e.g., http://coordinator:8700: the worker pulls whatever ranges of the census the coordinator leases it, rather than reading --census-file",
+					},
+					&cli.IntFlag{
+						Name:  "lease-size",
+						Usage: "number of DIDs in each range a coordinator leases out",
+						Value: pull.DefaultLeaseSize,
+					},
+					&cli.DurationFlag{
+						Name:  "lease-ttl",
+						Usage: "how long a coordinator's leases last without a heartbeat from their worker, after which they're leased to another worker",
+						Value: pull.DefaultLeaseTTL,
+					},
+					&cli.StringFlag{
+						Name:  "worker-id",
+						Usage: "name of this worker, for the coordinator's logs (if unspecified, the hostname and process ID)",
+					},
+				}, hydrationFlags(), dedupFlags()),
 			},
 			{
 				Name:   "hydrate",
 				Usage:  "Hydrate a folder of .car files into the same format as the stream",
 				Action: hydrateCmd,
-				Flags: []cli.Flag{
+				Flags: flags([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "input",
 						Usage:    "folder or file to read data from",
@@ -164,29 +352,226 @@ func run(args []string) {
 						Name:  "output-bq-table",
 						Usage: "name of a BigQuery table to output to in ID form (e.g., dgap_bsky.example_table)",
 					},
-				},
+					&cli.BoolFlag{
+						Name:  "offline",
+						Usage: "don't authenticate or make any network calls; identities and profiles come from the local snapshot (--census-file, --plc-export and the input CARs), and anything else is left unhydrated; the snapshot takes a first pass over the input, reading each CAR's profile record",
+					},
+					&cli.StringFlag{
+						Name:  "census-file",
+						Usage: "census file (from the census command) to limit the local snapshot to; load this if the PLC export is too big to hold in memory",
+					},
+					&cli.StringFlag{
+						Name:  "checkpoint",
+						Usage: "file to record finished CARs in, so that an interrupted run can be resumed by running the same command again (if unspecified, every CAR is hydrated)",
+					},
+					&cli.StringFlag{
+						Name:  "plc-export",
+						Usage: "PLC directory export (JSON lines, as served by https://plc.directory/export) to resolve identities from before going to the network",
+					},
+				}, hydrationFlags(), dedupFlags()),
 			},
 		},
 	}
 
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "YAML (.yaml, .yml or .json) or TOML (.toml) file to read flags from: global flags at the top level, and each command's flags in a section named after it",
+		},
+		&cli.StringFlag{
+			Name:    "log-level",
+			Usage:   "how much to log: debug, info, warn or error",
+			Value:   "info",
+			EnvVars: []string{"LOG_LEVEL"},
+		},
 		&cli.Int64Flag{
 			Name:  "cache-size",
 			Usage: "maximum size of the cache, in bytes",
 			Value: 1 << 32,
 		},
 		&cli.StringFlag{
-			Name:  "handle",
-			Usage: "handle to authenticate with, e.g., miles.land or det.bsky.social",
+			Name:  "persistent-cache",
+			Usage: "directory for an on-disk cache of identities, profiles and posts that survives restarts (if unspecified, only the in-memory cache is used)",
+		},
+		&cli.Int64Flag{
+			Name:  "persistent-cache-size",
+			Usage: "maximum size of the on-disk cache, in bytes (0 for unbounded)",
+			Value: 1 << 36,
+		},
+		&cli.DurationFlag{
+			Name:  "persistent-cache-ttl",
+			Usage: "how long entries in the on-disk cache stay fresh",
+			Value: 7 * 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "identity-history",
+			Usage: "add each actor's identity history (handle changes, PDS migrations and key rotations, from the PLC audit log) to their projection",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:    "handle",
+			Usage:   "handle to authenticate with, e.g., miles.land or det.bsky.social",
+			EnvVars: []string{"BLUESKY_HANDLE"},
+		},
+		&cli.StringFlag{
+			Name:    "password",
+			Usage:   "password to authenticate with",
+			EnvVars: []string{"BLUESKY_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "session-file",
+			Usage: "file to save sessions in, so that they're reused across restarts rather than logging in again every time (if unspecified, sessions aren't saved)",
+		},
+		&cli.StringFlag{
+			Name:  "credentials-file",
+			Usage: "file of accounts to authenticate with instead of --handle and --password, one {\"handle\": ..., \"password\": ...} per line; hydration requests take turns between them",
+		},
+		&cli.StringFlag{
+			Name:  "relay-host",
+			Usage: "relay to subscribe to the firehose of",
+			Value: "wss://bsky.network",
+		},
+		&cli.StringFlag{
+			Name:  "appview-host",
+			Usage: "AppView to hydrate posts, profiles and lists from",
+			Value: "https://public.api.bsky.app",
+		},
+		&cli.StringFlag{
+			Name:  "plc-host",
+			Usage: "PLC directory to resolve did:plc DIDs and audit logs with",
+			Value: "https://plc.directory",
+		},
+		&cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "requests per second to each host (the AppView, each PDS, the PLC directory, ...); hosts that send RateLimit headers are also paced to stay within what they report (0 for no limit beyond that)",
+			Value: hostlimit.DefaultRate,
+		},
+		&cli.StringSliceFlag{
+			Name:  "host-rate-limit",
+			Usage: "per-host override of --rate-limit, e.g., public.api.bsky.app=50 (may be repeated)",
+		},
+		&cli.IntFlag{
+			Name:  "breaker-failures",
+			Usage: "consecutive failures (network errors or 5xx responses) after which requests to a host fail fast for the cooldown (0 to never)",
+			Value: breaker.DefaultFailures,
+		},
+		&cli.DurationFlag{
+			Name:  "breaker-cooldown",
+			Usage: "how long requests to a failing host fail fast before one is let through to probe it",
+			Value: breaker.DefaultCooldown,
 		},
 		&cli.StringFlag{
-			Name:  "password",
-			Usage: "password to authenticate with",
+			Name:  "metrics-addr",
+			Usage: "address to serve Prometheus metrics (/metrics) and health checks (/healthz and /readyz) on, e.g., :9090 (if unspecified, they aren't served)",
+		},
+		&cli.DurationFlag{
+			Name:  "stall-timeout",
+			Usage: "how long a command can go without handling an event or writing a row before /healthz reports it as stalled (0 to never)",
+			Value: 5 * time.Minute,
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	// Every flag can also come from the environment or a config file (see
+	// pkg/config), which is loaded once the global flags are parsed, and
+	// applied to each command's flags once they are
+	config.AddEnvVars(app)
+	var cfg *config.Config
+
+	app.Before = func(cctx *cli.Context) error {
+		if path := cctx.String("config"); path != "" {
+			loaded, err := config.Load(path, app)
+			if err != nil {
+				return err
+			}
+			cfg = loaded
+		}
+		if err := cfg.Apply(cctx, "", app.Flags); err != nil {
+			return err
+		}
+
+		logLevel, err := log.ParseLevel(cctx.String("log-level"))
+		if err != nil {
+			return err
+		}
+		log.SetLevel(logLevel)
+
+		hostRates, err := hostlimit.ParseHostRates(cctx.StringSlice("host-rate-limit"))
+		if err != nil {
+			return err
+		}
+		hostlimit.Shared.Configure(cctx.Float64("rate-limit"), hostRates)
+		breaker.Shared.Configure(cctx.Int("breaker-failures"), cctx.Duration("breaker-cooldown"))
+
+		if addr := cctx.String("metrics-addr"); addr != "" {
+			go func() {
+				if err := metrics.Serve(addr, cctx.Duration("stall-timeout")); err != nil {
+					log.Fatalf("Failed to serve metrics: %+v", err)
+				}
+			}()
+		}
+		return nil
+	}
+
+	for _, command := range app.Commands {
+		command.Before = func(cctx *cli.Context) error {
+			if err := cfg.Apply(cctx, cctx.Command.Name, cctx.Command.Flags); err != nil {
+				return err
+			}
+
+			effective, err := config.Describe(cctx)
+			if err != nil {
+				return err
+			}
+			log.Infof("Effective configuration (secrets redacted): %s", effective)
+			return nil
+		}
+	}
+
+	return app
+}
+
+// flags joins a command's own flags with groups of flags that it shares with
+// other commands.
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var joined []cli.Flag
+	for _, group := range groups {
+		joined = append(joined, group...)
+	}
+	return joined
+}
+
+// hydrationFlags are for commands that hydrate records.
+func hydrationFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "hydration",
+			Usage: "how much to hydrate each record: none (raw records, no network calls), actor (adds the actor's identity), full (adds profiles and the subjects of likes, reposts, follows, blocks and list records), or deep (also resolves quoted posts and reply parents/roots)",
+			Value: "full",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hydration-collection",
+			Usage: "per-collection override of --hydration, e.g., app.bsky.feed.like=none (may be repeated)",
+		},
+	}
+}
+
+// dedupFlags are for commands that write records (see output.NewOutput).
+func dedupFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "dedup",
+			Usage: "drop rows that were already written (e.g., again after a restart or a re-run): none, set (remember keys exactly, on disk) or bloom (remember them in a rotating bloom filter, which is smaller but has a one in a million chance of dropping a new row)",
+			Value: "none",
+		},
+		&cli.StringFlag{
+			Name:  "dedup-state",
+			Usage: "directory (for set) or file (for bloom) to remember written rows in (if unspecified, the output file or BigQuery table's name with .dedup on the end)",
+		},
+		&cli.IntFlag{
+			Name:  "dedup-size",
+			Usage: "number of rows to remember for dedup; beyond that, the oldest are forgotten",
+			Value: dedup.DefaultSize,
+		},
 	}
 }
 
@@ -199,39 +584,124 @@ func waitOnSignals(ctx context.Context, signals chan os.Signal) {
 	}
 }
 
-func authenticate(cctx *cli.Context) (*xrpc.AuthInfo, error) {
+func authenticate(cctx *cli.Context) (*auth.Pool, error) {
 	authenticator, err := auth.MakeAuthenticator(cctx.Context)
 
 	if err != nil {
 		log.Fatalf("Failed to create authenticator: %+v", err)
 		return nil, err
 	}
+	authenticator.Directory = utils.IdentityDirectory(cctx.String("plc-host"))
 
-	handle := os.Getenv("BLUESKY_HANDLE")
-	if handle == "" {
-		handle = cctx.String("handle")
-		if handle == "" {
-			log.Fatal("No handle provided")
-			return nil, errors.New("No handle provided")
+	if path := cctx.String("session-file"); path != "" {
+		store, err := auth.OpenStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session file: %w", err)
 		}
+		authenticator.Store = store
 	}
 
-	password := os.Getenv("BLUESKY_PASSWORD")
-	if password == "" {
-		password = cctx.String("password")
-		if password == "" {
-			log.Fatal("No password provided")
-			return nil, errors.New("No password provided")
+	if path := cctx.String("credentials-file"); path != "" {
+		return authenticateAll(authenticator, path)
+	}
+
+	handle := cctx.String("handle")
+	password := cctx.String("password")
+
+	// The public AppView serves everything we hydrate with, so credentials
+	// are optional; without them, we go easy on it
+	if handle == "" && password == "" {
+		appview, err := url.Parse(cctx.String("appview-host"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AppView host: %w", err)
 		}
+		hostlimit.Shared.SetDefaultHostRate(appview.Host, hydrator.UnauthenticatedRate)
+		log.Infof("No credentials given, so not authenticating (and limiting requests to %s to %v per second, unless --host-rate-limit says otherwise)", appview.Host, hydrator.UnauthenticatedRate)
+		return auth.NewPool(), nil
+	}
+	if handle == "" {
+		log.Fatal("No handle provided")
+		return nil, errors.New("No handle provided")
+	}
+	if password == "" {
+		log.Fatal("No password provided")
+		return nil, errors.New("No password provided")
 	}
 
-	authInfo, err := authenticator.Authenticate(handle, password)
+	session, err := authenticator.Authenticate(handle, password)
 	if err != nil {
 		log.Fatalf("Failed to authenticate: %+v", err)
 		return nil, err
 	}
 
-	return authInfo, nil
+	return auth.NewPool(session), nil
+}
+
+// authenticateAll logs in to every account in a credentials file. Accounts that
+// fail to log in are skipped, so long as at least one succeeds.
+func authenticateAll(authenticator *auth.Authenticator, path string) (*auth.Pool, error) {
+	credentials, err := auth.LoadCredentials(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*auth.Session
+	for _, credential := range credentials {
+		session, err := authenticator.Authenticate(credential.Handle, credential.Password)
+		if err != nil {
+			log.Errorf("Failed to authenticate as %s, so skipping it: %+v", credential.Handle, err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("failed to authenticate as any of the %d accounts in %s", len(credentials), path)
+	}
+
+	log.Infof("Authenticated as %d of the %d accounts in %s", len(sessions), len(credentials), path)
+	return auth.NewPool(sessions...), nil
+}
+
+func makeHydrator(cctx *cli.Context, sessions *auth.Pool) (*hydrator.Hydrator, error) {
+	h, err := hydrator.MakeHydrator(cctx.Context, cctx.Int64("cache-size"), sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Client.Host = cctx.String("appview-host")
+	h.PLCHost = cctx.String("plc-host")
+	h.IdentityDirectory = utils.IdentityDirectory(h.PLCHost)
+
+	if name := cctx.String("hydration"); name != "" {
+		level, err := hydrator.ParseHydrationLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		h.Level = level
+	}
+
+	collectionLevels, err := hydrator.ParseCollectionHydrationLevels(cctx.StringSlice("hydration-collection"))
+	if err != nil {
+		return nil, err
+	}
+	h.CollectionLevels = collectionLevels
+
+	h.IdentityHistory = cctx.Bool("identity-history")
+
+	// Opened last, so that it's only left open (for the caller to close) if we
+	// succeed
+	if path := cctx.String("persistent-cache"); path != "" {
+		log.Infof("Using persistent cache at %s", path)
+		persistentCache, err := hydrator.OpenPersistentCache(path, cctx.Int64("persistent-cache-size"), cctx.Duration("persistent-cache-ttl"))
+		if err != nil {
+			return nil, err
+		}
+		h.PersistentCache = persistentCache
+	}
+
+	log.Infof("Hydrating records at level %s (collection overrides: %v)", h.Level, h.CollectionLevels)
+
+	return h, nil
 }
 
 func streamCmd(cctx *cli.Context) error {
@@ -244,23 +714,24 @@ func streamCmd(cctx *cli.Context) error {
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
 	// Create a client
-	authInfo, err := authenticate(cctx)
+	sessions, err := authenticate(cctx)
 	if err != nil {
 		log.Fatalf("Failed to authenticate: %+v", err)
 		return err
 	}
 
-	u, err := url.Parse("wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos")
+	u, err := url.Parse(strings.TrimSuffix(cctx.String("relay-host"), "/") + "/xrpc/com.atproto.sync.subscribeRepos")
 	if err != nil {
 		log.Fatalf("Failed to parse ws-url: %+v", err)
 		return err
 	}
 
-	hydrator, err := hydrator.MakeHydrator(cctx.Context, cctx.Int64("cache-size"), authInfo)
+	hydrator, err := makeHydrator(cctx, sessions)
 	if err != nil {
 		log.Fatalf("Failed to create hydrator: %+v", err)
 		return err
 	}
+	defer hydrator.Close()
 
 	outputChannel := make(chan map[string]interface{}, 512)
 
@@ -276,12 +747,23 @@ func streamCmd(cctx *cli.Context) error {
 		log.Fatalf("Failed to setup output: %+v", err)
 		return err
 	}
+	defer output.Close()
+
+	var streamShard shard.Shard
+	if value := cctx.String("shard"); value != "" {
+		streamShard, err = shard.Parse(value)
+		if err != nil {
+			log.Fatalf("Failed to parse shard: %+v", err)
+			return err
+		}
+		log.Infof("Handling shard %s of the firehose", streamShard)
+	}
 
 	var lastSeq int64 = cctx.Int64("backfill-seq")
 
 	if lastSeq == 0 {
 		log.Infof("No backfill seq specified, so attempting to backfill from the last line of the output file...")
-		seqno, err := output.GetBackfillSeqno()
+		seqno, err := output.GetBackfillSeqno(streamShard)
 		if err != nil {
 			log.Warnf("Failed to get backfill seqno: %+v", err)
 			log.Warnf("Continuing without backfill...")
@@ -298,6 +780,8 @@ func streamCmd(cctx *cli.Context) error {
 		Output:      outputChannel,
 		Hydrator:    hydrator,
 		BackfillSeq: lastSeq,
+		Verify:      cctx.Bool("verify"),
+		Shard:       streamShard,
 	}
 
 	go func() {
@@ -325,7 +809,7 @@ func streamCmd(cctx *cli.Context) error {
 	return nil
 }
 
-func censusCmd(cctx *cli.Context) error {
+func recordCmd(cctx *cli.Context) error {
 	ctx := cctx.Context
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -334,70 +818,361 @@ func censusCmd(cctx *cli.Context) error {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	// Open the output file
-	outputFile, err := os.Create(cctx.String("output-file"))
+	u, err := url.Parse(strings.TrimSuffix(cctx.String("relay-host"), "/") + "/xrpc/com.atproto.sync.subscribeRepos")
 	if err != nil {
-		log.Fatalf("Failed to open output file: %+v", err)
+		log.Fatalf("Failed to parse ws-url: %+v", err)
 		return err
 	}
-	defer outputFile.Close()
 
-	// Authenticate
-	// authInfo, err := authenticate(cctx)
-	// if err != nil {
-	// 	log.Fatalf("Failed to authenticate: %+v", err)
-	// 	return err
-	// }
+	dir := cctx.String("output-dir")
+	var lastSeq int64 = cctx.Int64("backfill-seq")
 
-	// This command is pretty simple; it doesn't require it's own package. It
-	// lists all the users on the network, then for each one outputs a JSON
-	// object with the user's DID, some basic metadata, and "_pulled": false
-	// (indicating that we haven't pulled their data yet). The output of this
-	// command can be fed to the pull command to pull all the data from all the
-	// users on the network, with hydration.
-	pdsEndpoint := cctx.String("pds-endpoint")
+	if lastSeq == 0 {
+		log.Infof("No backfill seq specified, so attempting to backfill from the most recent segment...")
+		seqno, err := archive.LastSeq(ctx, dir)
+		if err != nil {
+			log.Warnf("Failed to get backfill seqno: %+v", err)
+			log.Warnf("Continuing without backfill...")
+		} else if seqno < 0 {
+			log.Infof("No segments recorded yet, so starting from the live firehose")
+		} else {
+			log.Infof("Backfilling from seq: %d", seqno)
+			lastSeq = seqno
+		}
+	} else {
+		log.Infof("Backfilling from provided seq: %d", lastSeq)
+	}
 
-	xrpcClient := &xrpc.Client{
-		Client: utils.RetryingHTTPClient(),
-		Host:   pdsEndpoint,
+	writer, err := archive.NewSegmentWriter(dir, cctx.Int64("segment-size"), cctx.Duration("segment-duration"))
+	if err != nil {
+		log.Fatalf("Failed to create segment writer: %+v", err)
+		return err
 	}
 
-	cursor := ""
+	r := archive.Recorder{
+		SocketURL:   u,
+		Writer:      writer,
+		BackfillSeq: lastSeq,
+	}
 
+	done := make(chan struct{})
 	go func() {
-		defer cancel()
-
+		defer close(done)
 		for {
-			out, err := comatproto.SyncListRepos(ctx, xrpcClient, cursor, 1000)
-			if err != nil {
-				log.Fatalf("Failed to get list of repos: %v", err)
+			err := r.BeginRecording(ctx)
+			log.Errorf("Recording ended unexpectedly: %+v", err)
+
+			if !cctx.Bool("autorestart") || ctx.Err() != nil {
+				log.Infof("Exiting...")
+				break
 			} else {
-				log.Infof("Got %d repos from %s (cursor = %s)", len(out.Repos), pdsEndpoint, cursor)
+				log.Infof("Restarting recording...")
 			}
+		}
+		cancel()
+	}()
 
-			if len(out.Repos) == 0 {
-				log.Infof("Finished pulling DIDs from: %s", pdsEndpoint)
-				break
+	if cctx.Bool("autorestart") {
+		log.Infof("Autorestart is enabled! Recording will restart if it dies...")
+	}
+
+	waitOnSignals(ctx, signals)
+
+	// Make sure the current segment is finished before we exit
+	cancel()
+	<-done
+	if err := writer.Close(); err != nil {
+		log.Errorf("Failed to finish the current segment: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+func replayCmd(cctx *cli.Context) error {
+	ctx := cctx.Context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Trap SIGINT to trigger a shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Create a client
+	sessions, err := authenticate(cctx)
+	if err != nil {
+		log.Fatalf("Failed to authenticate: %+v", err)
+		return err
+	}
+
+	hydrator, err := makeHydrator(cctx, sessions)
+	if err != nil {
+		log.Fatalf("Failed to create hydrator: %+v", err)
+		return err
+	}
+	defer hydrator.Close()
+
+	outputChannel := make(chan map[string]interface{}, 512)
+
+	output, err := output.NewOutput(cctx, outputChannel)
+	if err != nil {
+		log.Fatalf("Failed to create output: %+v", err)
+		return err
+	}
+
+	// Setup the output
+	err = output.Setup()
+	if err != nil {
+		log.Fatalf("Failed to setup output: %+v", err)
+		return err
+	}
+	defer output.Close()
+
+	r := archive.Replayer{
+		Dir: cctx.String("input-dir"),
+		Stream: &stream.Stream{
+			Output:   outputChannel,
+			Hydrator: hydrator,
+			Verify:   cctx.Bool("verify"),
+		},
+		FromSeq: cctx.Int64("from-seq"),
+		ToSeq:   cctx.Int64("to-seq"),
+		Speed:   cctx.Float64("speed"),
+	}
+
+	// Once everything has been replayed, let the output drain and then exit
+	go func() {
+		err := r.Replay(ctx)
+		if err != nil {
+			log.Errorf("Replay ended unexpectedly: %+v", err)
+		}
+		close(outputChannel)
+	}()
+
+	go func() {
+		output.StreamOutput(ctx)
+		cancel()
+	}()
+
+	waitOnSignals(ctx, signals)
+	return nil
+}
+
+func labelsCmd(cctx *cli.Context) error {
+	ctx := cctx.Context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Trap SIGINT to trigger a shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Label streams are public, so we don't authenticate; we only need the
+	// hydrator to resolve labelers' identities
+	hydrator, err := makeHydrator(cctx, nil)
+	if err != nil {
+		log.Fatalf("Failed to create hydrator: %+v", err)
+		return err
+	}
+	defer hydrator.Close()
+
+	// Rows go through a tracker, so that each labeler's cursor only moves
+	// once its labels have been written
+	outputChannel := make(chan map[string]interface{}, 512)
+	tracker := output.NewTracker(outputChannel)
+
+	output, err := output.NewTrackedOutput(cctx, tracker)
+	if err != nil {
+		log.Fatalf("Failed to create output: %+v", err)
+		return err
+	}
+
+	// Setup the output
+	err = output.Setup()
+	if err != nil {
+		log.Fatalf("Failed to setup output: %+v", err)
+		return err
+	}
+	defer output.Close()
+
+	services := cctx.StringSlice("labeler")
+	backfillSeqs := make(map[string]int64)
+
+	// Sequence numbers are per-labeler, so we can only backfill from a single
+	// seq (or from the output) if there's only one labeler
+	if len(services) == 1 {
+		identity, err := hydrator.LookupIdentity(services[0])
+		if err != nil {
+			log.Fatalf("Failed to resolve labeler %s: %+v", services[0], err)
+			return err
+		}
+
+		if seq := cctx.Int64("backfill-seq"); seq != 0 {
+			log.Infof("Backfilling from provided seq: %d", seq)
+			backfillSeqs[identity.DID.String()] = seq
+		}
+	} else if cctx.Int64("backfill-seq") != 0 {
+		log.Fatalf("--backfill-seq can only be used with a single labeler")
+		return errors.New("--backfill-seq can only be used with a single labeler")
+	}
+
+	s := labels.LabelStream{
+		Services:        services,
+		Output:          outputChannel,
+		Tracker:         tracker,
+		Hydrator:        hydrator,
+		CursorStatePath: cctx.String("cursor-state"),
+		BackfillSeq:     backfillSeqs,
+		Autorestart:     cctx.Bool("autorestart"),
+	}
+
+	go func() {
+		err := s.BeginStreaming(ctx)
+		if err != nil {
+			log.Errorf("Label streaming ended unexpectedly: %+v", err)
+		}
+		cancel()
+	}()
+
+	go output.StreamOutput(ctx)
+
+	waitOnSignals(ctx, signals)
+	return nil
+}
+
+func identityHistoryCmd(cctx *cli.Context) error {
+	ctx := cctx.Context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Trap SIGINT to trigger a shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// The PLC directory is public, so we don't authenticate
+	hydrator, err := makeHydrator(cctx, nil)
+	if err != nil {
+		log.Fatalf("Failed to create hydrator: %+v", err)
+		return err
+	}
+	defer hydrator.Close()
+
+	outputChannel := make(chan map[string]interface{}, 10000)
+
+	output, err := output.NewOutput(cctx, outputChannel)
+	if err != nil {
+		log.Fatalf("Failed to create output: %+v", err)
+		return err
+	}
+
+	// Setup the output
+	err = output.Setup()
+	if err != nil {
+		log.Fatalf("Failed to setup output: %+v", err)
+		return err
+	}
+	defer output.Close()
+
+	censusFile, err := os.Open(cctx.String("census-file"))
+	if err != nil {
+		log.Fatalf("Failed to open census file: %+v", err)
+		return err
+	}
+	defer censusFile.Close()
+
+	// Read the DIDs out of the census file
+	dids := make(chan string, 10000)
+	go func() {
+		defer close(dids)
+		scanner := bufio.NewScanner(censusFile)
+		for scanner.Scan() {
+			var entry census.CensusFileEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Fatalf("Failed to decode census file line: %+v", err)
 			}
-			cursor = *out.Cursor
-
-			for _, r := range out.Repos {
-				// Write the repo information to the output file
-				data := census.CensusFileEntry{
-					Did:  r.Did,
-					Rev:  r.Rev,
-					Head: r.Head,
-				}
 
-				// Marshall + write to file, with newline
-				marshalled, err := json.Marshal(data)
+			// Only did:plc accounts have a PLC audit log
+			if !strings.HasPrefix(entry.Did, "did:plc:") {
+				log.Debugf("Skipping %s, since it isn't a did:plc account", entry.Did)
+				continue
+			}
+
+			select {
+			case dids <- entry.Did:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Spawn workers to pull the identity histories
+	var wg sync.WaitGroup
+	for i := 0; i < cctx.Int("worker-count"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for did := range dids {
+				rows, err := hydrator.HydrateIdentityHistory(did)
 				if err != nil {
-					// If this fails, uh, what? How could this fail? Must be a
-					// cosmic ray or something.
-					log.Fatalf("Failed to marshal data: %+v", err)
+					log.Errorf("Failed to get identity history for %s: %+v", did, err)
+					continue
+				}
+
+				for _, row := range rows {
+					outputChannel <- row
 				}
-				outputFile.Write(append(marshalled, '\n'))
 			}
+		}()
+	}
+
+	// Once every DID has been processed, let the output drain and then exit
+	go func() {
+		wg.Wait()
+		log.Infof("Finished pulling identity histories")
+		close(outputChannel)
+	}()
+
+	go func() {
+		output.StreamOutput(ctx)
+		cancel()
+	}()
+
+	waitOnSignals(ctx, signals)
+	return nil
+}
+
+func censusCmd(cctx *cli.Context) error {
+	ctx := cctx.Context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Trap SIGINT to trigger a shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Open the output file
+	outputFile, err := os.Create(cctx.String("output-file"))
+	if err != nil {
+		log.Fatalf("Failed to open output file: %+v", err)
+		return err
+	}
+	defer outputFile.Close()
+
+	// Authenticate
+	// authInfo, err := authenticate(cctx)
+	// if err != nil {
+	// 	log.Fatalf("Failed to authenticate: %+v", err)
+	// 	return err
+	// }
+
+	// Several endpoints can be given, e.g., the relay plus self-hosted PDSes
+	// (which may host did:web accounts that the relay doesn't know about).
+	go func() {
+		defer cancel()
+
+		err := census.Take(ctx, cctx.StringSlice("pds-endpoint"), outputFile)
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("Failed to take census: %+v", err)
 		}
 	}()
 
@@ -414,21 +1189,50 @@ func pullCmd(cctx *cli.Context) error {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+	if cctx.String("serve-leases") != "" && cctx.String("coordinator") != "" {
+		log.Fatal("Only one of --serve-leases and --coordinator may be given")
+		return errors.New("only one of --serve-leases and --coordinator may be given")
+	}
+
+	// Coordinators only hand out work, so they don't need to authenticate,
+	// hydrate or output anything
+	if addr := cctx.String("serve-leases"); addr != "" {
+		coordinator := &pull.Coordinator{
+			CensusPath:            cctx.String("census-file"),
+			IntermediateStatePath: cctx.String("intermediate-state"),
+			LeaseSize:             cctx.Int("lease-size"),
+			LeaseTTL:              cctx.Duration("lease-ttl"),
+		}
+
+		go func() {
+			if err := coordinator.Serve(ctx, addr); err != nil {
+				log.Errorf("Coordinating ended unexpectedly: %+v", err)
+			}
+			cancel()
+		}()
+
+		waitOnSignals(ctx, signals)
+		return nil
+	}
+
 	// Authenticate
-	authInfo, err := authenticate(cctx)
+	sessions, err := authenticate(cctx)
 	if err != nil {
 		log.Fatalf("Failed to authenticate: %+v", err)
 		return err
 	}
 
-	hydrator, err := hydrator.MakeHydrator(cctx.Context, cctx.Int64("cache-size"), authInfo)
+	hydrator, err := makeHydrator(cctx, sessions)
 	if err != nil {
 		log.Fatalf("Failed to create hydrator: %+v", err)
 		return err
 	}
+	defer hydrator.Close()
 
-	// Create the output channel
+	// Create the output channel. Rows go through a tracker, so that DIDs are
+	// only recorded as pulled once their rows have been written.
 	outputChannel := make(chan map[string]interface{}, 10000)
+	tracker := output.NewTracker(outputChannel)
 
 	// Create a client
 	client := &pull.Pull{
@@ -436,6 +1240,7 @@ func pullCmd(cctx *cli.Context) error {
 		IntermediateStatePath:       cctx.String("intermediate-state"),
 		PdsEndpoint:                 cctx.String("pds-endpoint"),
 		Output:                      outputChannel,
+		Tracker:                     tracker,
 		Hydrator:                    hydrator,
 		FirstUnpulledDidIndex:       0,
 		RecentlyPulledCensusIndices: make([]uint64, 10000),      // 10k should be enough, since we can always resize
@@ -443,7 +1248,7 @@ func pullCmd(cctx *cli.Context) error {
 	}
 
 	// Setup the output
-	output, err := output.NewOutput(cctx, outputChannel)
+	output, err := output.NewTrackedOutput(cctx, tracker)
 	if err != nil {
 		log.Fatalf("Failed to create output: %+v", err)
 		return err
@@ -455,11 +1260,23 @@ func pullCmd(cctx *cli.Context) error {
 		log.Fatalf("Failed to setup output: %+v", err)
 		return err
 	}
+	defer output.Close()
 
-	// Start downloading repos
+	// Start downloading repos, from the census file or from whatever a
+	// coordinator leases us
 	go func() {
-		err := client.BeginDownloading(ctx, cctx.Int("worker-count"))
-		log.Errorf("Downloading ended unexpectedly: %+v", err)
+		if coordinatorURL := cctx.String("coordinator"); coordinatorURL != "" {
+			workerID := cctx.String("worker-id")
+			if workerID == "" {
+				workerID = pull.DefaultWorkerID()
+			}
+			client.CompletedIndicesChannel = nil
+			err := client.BeginWorking(ctx, coordinatorURL, workerID, cctx.Int("worker-count"))
+			log.Errorf("Working ended unexpectedly: %+v", err)
+		} else {
+			err := client.BeginDownloading(ctx, cctx.Int("worker-count"))
+			log.Errorf("Downloading ended unexpectedly: %+v", err)
+		}
 		cancel()
 	}()
 
@@ -470,6 +1287,65 @@ func pullCmd(cctx *cli.Context) error {
 	return nil
 }
 
+// Builds the local snapshot for hydrate from the census file and PLC export (if
+// given), plus the profile record in every CAR in the input. This is a pass
+// over the input before hydrate's own, but it only reads each CAR's profile.
+func loadSnapshot(ctx context.Context, cctx *cli.Context) (*hydrator.Snapshot, error) {
+	snapshot := hydrator.NewSnapshot()
+
+	if path := cctx.String("census-file"); path != "" {
+		if err := snapshot.LoadCensus(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := cctx.String("plc-export"); path != "" {
+		if err := snapshot.LoadPLCExport(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Even CARs that a previous run already hydrated count towards profiles
+	sources := make(chan carfiles.Source, cctx.Int("worker-count"))
+	var walkErr error
+	go func() {
+		defer close(sources)
+		walkErr = carfiles.Walk(ctx, cctx.String("input"), func(string) bool { return false }, sources)
+	}()
+
+	var wg sync.WaitGroup
+	var added atomic.Int64
+	for i := 0; i < cctx.Int("worker-count"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range sources {
+				repo, err := source.Load(ctx)
+				if err != nil {
+					log.Errorf("Failed to read repo from %s: %+v", source.Name, err)
+					continue
+				}
+				if err := snapshot.AddRepo(ctx, repo); err != nil {
+					log.Errorf("Failed to add %s to the local snapshot: %+v", source.Name, err)
+					continue
+				}
+				if n := added.Add(1); n%10_000 == 0 {
+					log.Infof("Added %d repos to the local snapshot", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if walkErr != nil {
+		return nil, fmt.Errorf("failed to walk input: %w", walkErr)
+	}
+
+	log.Infof("Added %d repos to the local snapshot", added.Load())
+
+	return snapshot, nil
+}
+
 func hydrateCmd(cctx *cli.Context) error {
 	ctx := cctx.Context
 	ctx, cancel := context.WithCancel(ctx)
@@ -479,25 +1355,59 @@ func hydrateCmd(cctx *cli.Context) error {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	// Create a client
-	log.Infof("Authenticating...")
-	authInfo, err := authenticate(cctx)
-	if err != nil {
-		log.Fatalf("Failed to authenticate: %+v", err)
-		return err
+	offline := cctx.Bool("offline")
+
+	// Create a client (unless we're air-gapped)
+	var sessions *auth.Pool
+	if offline {
+		log.Infof("Running offline, so not authenticating")
+	} else {
+		log.Infof("Authenticating...")
+		var err error
+		sessions, err = authenticate(cctx)
+		if err != nil {
+			log.Fatalf("Failed to authenticate: %+v", err)
+			return err
+		}
 	}
 
 	log.Infof("Creating hydrator...")
-	hydrator, err := hydrator.MakeHydrator(cctx.Context, cctx.Int64("cache-size"), authInfo)
+	hydrator, err := makeHydrator(cctx, sessions)
 	if err != nil {
 		log.Fatalf("Failed to create hydrator: %+v", err)
 		return err
 	}
+	defer hydrator.Close()
+	hydrator.Offline = offline
+
+	if offline || cctx.String("census-file") != "" || cctx.String("plc-export") != "" {
+		log.Infof("Loading local snapshot...")
+		snapshot, err := loadSnapshot(ctx, cctx)
+		if err != nil {
+			log.Fatalf("Failed to load local snapshot: %+v", err)
+			return err
+		}
+		hydrator.Local = snapshot
+	}
+
+	var checkpoint *carfiles.Checkpoint
+	if path := cctx.String("checkpoint"); path != "" {
+		checkpoint, err = carfiles.OpenCheckpoint(path)
+		if err != nil {
+			log.Fatalf("Failed to open checkpoint: %+v", err)
+			return err
+		}
+		defer checkpoint.Close()
+	}
 
 	outputChannel := make(chan map[string]interface{}, 10000)
 
+	// Rows go through a tracker, so that CARs are only marked done once their
+	// rows have been written
+	tracker := output.NewTracker(outputChannel)
+
 	log.Infof("Creating output...")
-	output, err := output.NewOutput(cctx, outputChannel)
+	output, err := output.NewTrackedOutput(cctx, tracker)
 	if err != nil {
 		log.Fatalf("Failed to create output: %+v", err)
 		return err
@@ -509,81 +1419,124 @@ func hydrateCmd(cctx *cli.Context) error {
 		log.Fatalf("Failed to setup output: %+v", err)
 		return err
 	}
+	defer output.Close()
 
-	// Find all the CARs; i.e., every `.car` file in the input folder (could be nested)
-	// and then hydrate them.
-	carFiles := make(chan string, 10000)
+	// A signal stops hydration, but the output keeps going until it has written
+	// everything that was already hydrated. A second signal exits right away.
+	hydrateCtx, stopHydrating := context.WithCancel(ctx)
+	defer stopHydrating()
 	go func() {
-		defer close(carFiles)
-		carFilesCount := 0
-		input := cctx.String("input")
-		err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if strings.HasSuffix(path, ".car") {
-				carFiles <- path
-				carFilesCount++
-			}
-			return nil
-		})
-		if err != nil {
-			log.Fatalf("Failed to walk input folder: %+v", err)
+		select {
+		case <-signals:
+			log.Infof("Shutting down on signal; finishing output (signal again to exit immediately)")
+			signal.Stop(signals)
+			stopHydrating()
+		case <-hydrateCtx.Done():
 		}
+	}()
 
-		log.Infof("Found %d car files to hydrate in %s.", carFilesCount, input)
+	// Find all the CARs in the input (files, compressed files and archives,
+	// possibly nested in folders) that aren't done yet, and then hydrate them.
+	// Archive entries are read ahead of the workers, so keep the queue short.
+	sources := make(chan carfiles.Source, cctx.Int("worker-count"))
+	go func() {
+		defer close(sources)
+		input := cctx.String("input")
+		err := carfiles.Walk(hydrateCtx, input, func(name string) bool {
+			return checkpoint != nil && checkpoint.Done(name)
+		}, sources)
+		if err != nil && hydrateCtx.Err() == nil {
+			log.Fatalf("Failed to walk input: %+v", err)
+		}
 	}()
 
 	// Spawn workers to hydrate the CARs
+	var wg sync.WaitGroup
+	var hydratedCount, failedCount atomic.Int64
 	for i := 0; i < cctx.Int("worker-count"); i++ {
+		wg.Add(1)
 		go func() {
-			for carFile := range carFiles {
-				log.Infof("Hydrating %s", carFile)
-				// Read the car file
-				data, err := os.ReadFile(carFile)
+			defer wg.Done()
+			for source := range sources {
+				log.Infof("Hydrating %s", source.Name)
+				repo, err := source.Load(hydrateCtx)
 				if err != nil {
-					log.Errorf("Failed to read car file: %+v", err)
-					continue
-				}
-				repo, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(data))
-				if err != nil {
-					log.Errorf("Failed to read repo from car: %+v", err)
+					log.Errorf("Failed to read repo from %s: %+v", source.Name, err)
+					failedCount.Add(1)
 					continue
 				}
 				// Extract the actor (i.e., whose repo is this?)
 				actorDid := repo.RepoDid()
 
 				// Hydrate the repo
-				err = repo.ForEach(ctx, "", func(k string, v cid.Cid) error {
+				rows := tracker.NewBatch()
+				err = repo.ForEach(hydrateCtx, "", func(k string, v cid.Cid) error {
+					if hydrateCtx.Err() != nil {
+						return hydrateCtx.Err()
+					}
+
 					// Get the record
-					_, rec, err := repo.GetRecord(ctx, k)
+					rc, rec, err := repo.GetRecord(hydrateCtx, k)
 					if err != nil {
 						log.Errorf("Unable to parse CID %s from %s: %s", v.String(), actorDid, err)
 						return err
 					}
 
 					// Hydrate the record
-					hydrated, err := hydrator.Hydrate(rec, actorDid)
+					hydrated, err := hydrator.Hydrate(rec, actorDid, k)
 					if err != nil {
 						log.Errorf("Failed to hydrate record: %+v", err)
 						return err
 					}
+					hydrator.SetCID(hydrated, rc)
 
 					// Write the hydrated record to the output
-					outputChannel <- hydrated
+					rows.Send(hydrated)
 
 					return nil
 				})
 
 				if err != nil {
-					log.Errorf("Failed to hydrate repo: %+v", err)
+					if hydrateCtx.Err() == nil {
+						log.Errorf("Failed to hydrate repo: %+v", err)
+						failedCount.Add(1)
+					}
+					rows.Close(func(bool) {})
+					continue
 				}
+
+				// The CAR is only done once the output has written its rows
+				rows.Close(func(written bool) {
+					if !written {
+						log.Errorf("Failed to write some of the rows from %s", source.Name)
+						failedCount.Add(1)
+						return
+					}
+					hydratedCount.Add(1)
+					if checkpoint != nil {
+						if err := checkpoint.MarkDone(source.Name); err != nil {
+							log.Errorf("Failed to update checkpoint: %+v", err)
+						}
+					}
+				})
 			}
 		}()
 	}
 
-	go output.StreamOutput(ctx)
+	outputDone := make(chan error, 1)
+	go func() {
+		outputDone <- output.StreamOutput(ctx)
+	}()
 
-	waitOnSignals(ctx, signals)
+	// Once every CAR is done (or we've been interrupted), let the output flush
+	// what's left and exit
+	wg.Wait()
+	close(outputChannel)
+	if err := <-outputDone; err != nil {
+		log.Errorf("Output failed: %+v", err)
+		return err
+	}
+
+	log.Infof("Hydrated %d CARs (%d failed)", hydratedCount.Load(), failedCount.Load())
 	return nil
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/stanfordio/skyfall/pkg/testsupport"
+)
+
+// Runs skyfall against the fake network, as it would be run from the command
+// line.
+func runSkyfall(ctx context.Context, network *testsupport.Network, args ...string) error {
+	global := []string{
+		"skyfall",
+		"--relay-host", network.RelayURL(),
+		"--appview-host", network.URL(),
+		"--plc-host", network.URL(),
+	}
+	return newApp().RunContext(ctx, append(global, args...))
+}
+
+// Starts a command that only stops when it's cancelled (e.g., stream), and
+// returns a function that stops it and waits for it to exit.
+func startSkyfall(t *testing.T, network *testsupport.Network, args ...string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runSkyfall(ctx, network, args...)
+	}()
+
+	return func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("skyfall %v: %v", args, err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Errorf("skyfall %v didn't stop", args)
+		}
+	}
+}
+
+func readRows(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Failed to parse row %q: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// Waits for a command that runs until it's stopped to have written count rows.
+func waitForRows(t *testing.T, path string, count int) []map[string]interface{} {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		rows := readRows(t, path)
+		if len(rows) >= count {
+			return rows
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d rows in %s (got %d)", count, path, len(rows))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func field(row map[string]interface{}, path ...string) interface{} {
+	var value interface{} = row
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// The fake network, with alice's posts and bob's follow of alice
+type fixture struct {
+	network *testsupport.Network
+	alice   *testsupport.Account
+	bob     *testsupport.Account
+	uris    map[string]string // URI -> DID of the record's actor
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	ctx := context.Background()
+
+	network := testsupport.NewNetwork()
+	t.Cleanup(network.Close)
+
+	f := &fixture{network: network, uris: make(map[string]string)}
+
+	var err error
+	if f.alice, err = network.CreateAccount(ctx, "alice.test"); err != nil {
+		t.Fatal(err)
+	}
+	if f.bob, err = network.CreateAccount(ctx, "bob.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		path, _, err := network.CreateRecord(ctx, f.alice, "app.bsky.feed.post", &bsky.FeedPost{
+			Text:      fmt.Sprintf("post %d", i),
+			CreatedAt: time.Now().Format(time.RFC3339),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.uris["at://"+f.alice.DID+"/"+path] = f.alice.DID
+	}
+
+	path, _, err := network.CreateRecord(ctx, f.bob, "app.bsky.graph.follow", &bsky.GraphFollow{
+		Subject:   f.alice.DID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.uris["at://"+f.bob.DID+"/"+path] = f.bob.DID
+
+	return f
+}
+
+// checkRows checks that there's a row for each of the fixture's records,
+// with the right actor.
+func (f *fixture) checkRows(t *testing.T, rows []map[string]interface{}) {
+	t.Helper()
+
+	if len(rows) != len(f.uris) {
+		t.Errorf("Got %d rows, expected %d", len(rows), len(f.uris))
+	}
+
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		uri, _ := row["URI"].(string)
+		did, ok := f.uris[uri]
+		if !ok {
+			t.Errorf("Unexpected row for %q", uri)
+			continue
+		}
+		if seen[uri] {
+			t.Errorf("Duplicate row for %s", uri)
+		}
+		seen[uri] = true
+
+		if actor := field(row, "Projection", "Actor", "DID"); actor != did {
+			t.Errorf("Row for %s has actor %v, expected %s", uri, actor, did)
+		}
+		if did == f.alice.DID {
+			if text, _ := field(row, "Full", "Text").(string); text == "" {
+				t.Errorf("Row for %s has no text", uri)
+			}
+		} else if subject := field(row, "Full", "Subject"); subject != f.alice.DID {
+			t.Errorf("Row for %s follows %v, expected %s", uri, subject, f.alice.DID)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	f := newFixture(t)
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "output.jsonl")
+
+	stop := startSkyfall(t, f.network, "stream",
+		"--hydration", "actor",
+		"--worker-count", "2",
+		"--autorestart=false",
+		"--output-file", outputFile,
+	)
+	rows := waitForRows(t, outputFile, len(f.uris))
+	stop()
+
+	rows = readRows(t, outputFile)
+	f.checkRows(t, rows)
+
+	seqs := make(map[float64]bool)
+	for _, row := range rows {
+		if row["Action"] != "create" {
+			t.Errorf("Row for %v has action %v, expected create", row["URI"], row["Action"])
+		}
+		seq, _ := row["Seq"].(float64)
+		if seq <= 0 || seqs[seq] {
+			t.Errorf("Row for %v has seq %v, expected a new one", row["URI"], row["Seq"])
+		}
+		seqs[seq] = true
+	}
+}
+
+func TestCensus(t *testing.T) {
+	f := newFixture(t)
+	dir := t.TempDir()
+	censusFile := filepath.Join(dir, "census.jsonl")
+
+	err := runSkyfall(context.Background(), f.network, "census",
+		"--pds-endpoint", f.network.URL(),
+		"--output-file", censusFile,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dids []string
+	for _, row := range readRows(t, censusFile) {
+		did, _ := row["Did"].(string)
+		dids = append(dids, did)
+		if head, _ := row["Head"].(string); head == "" {
+			t.Errorf("Census entry for %s has no head", did)
+		}
+	}
+	sort.Strings(dids)
+
+	expected := []string{f.alice.DID, f.bob.DID}
+	sort.Strings(expected)
+	if fmt.Sprint(dids) != fmt.Sprint(expected) {
+		t.Errorf("Census has %v, expected %v", dids, expected)
+	}
+}
+
+func TestPull(t *testing.T) {
+	f := newFixture(t)
+	dir := t.TempDir()
+	censusFile := filepath.Join(dir, "census.jsonl")
+	outputFile := filepath.Join(dir, "output.jsonl")
+
+	err := runSkyfall(context.Background(), f.network, "census",
+		"--pds-endpoint", f.network.URL(),
+		"--output-file", censusFile,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startSkyfall(t, f.network, "pull",
+		"--census-file", censusFile,
+		"--intermediate-state", filepath.Join(dir, "intermediate-state.json"),
+		"--pds-endpoint", f.network.URL(),
+		"--hydration", "actor",
+		"--worker-count", "2",
+		"--output-file", outputFile,
+	)
+	waitForRows(t, outputFile, len(f.uris))
+	stop()
+
+	rows := readRows(t, outputFile)
+	f.checkRows(t, rows)
+
+	for _, row := range rows {
+		if cid, _ := field(row, "Full", "_CID").(string); cid == "" {
+			t.Errorf("Row for %v has no CID", row["URI"])
+		}
+	}
+}
+
+func TestHydrate(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	inputDir := filepath.Join(dir, "input")
+	outputFile := filepath.Join(dir, "output.jsonl")
+	checkpointFile := filepath.Join(dir, "checkpoint")
+
+	if err := os.Mkdir(inputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cars := []string{filepath.Join(inputDir, "alice.car"), filepath.Join(inputDir, "bob.car")}
+	if err := f.network.WriteCAR(ctx, f.alice.DID, cars[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.network.WriteCAR(ctx, f.bob.DID, cars[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	hydrate := func() {
+		t.Helper()
+		err := runSkyfall(ctx, f.network, "hydrate",
+			"--input", inputDir,
+			"--hydration", "actor",
+			"--worker-count", "2",
+			"--output-file", outputFile,
+			"--checkpoint", checkpointFile,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hydrate()
+	f.checkRows(t, readRows(t, outputFile))
+
+	checkpoint, err := os.ReadFile(checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := strings.Fields(string(checkpoint))
+	sort.Strings(done)
+	if fmt.Sprint(done) != fmt.Sprint(cars) {
+		t.Errorf("Checkpoint has %v, expected %v", done, cars)
+	}
+
+	// Everything's done, so running it again doesn't write anything
+	hydrate()
+	if rows := readRows(t, outputFile); len(rows) != len(f.uris) {
+		t.Errorf("Got %d rows after hydrating again, expected %d", len(rows), len(f.uris))
+	}
+}
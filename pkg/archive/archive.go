@@ -0,0 +1,329 @@
+package archive
+
+// Raw firehose frames are archived in zstd-compressed segment files. Each
+// segment is named after the first seq it contains, so finding where a seq
+// lives is just a matter of listing the directory. Within a segment, each frame
+// is stored as:
+//
+//	varint seq | varint receive time (unix nanoseconds) | uvarint length | frame
+//
+// where the frame is the websocket message exactly as the relay sent it (the
+// CBOR header followed by the CBOR body).
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	segmentSuffix = ".frames.zst"
+	partialSuffix = ".partial" // Appended to the segment that is still being written
+)
+
+type Frame struct {
+	Seq        int64 // -1 for frames without a seq (e.g., info and error frames)
+	ReceivedAt time.Time
+	Data       []byte
+}
+
+type Segment struct {
+	Path     string
+	FirstSeq int64
+}
+
+// SegmentWriter writes frames to a directory of segments, rotating to a new
+// segment once the current one gets too big or too old.
+type SegmentWriter struct {
+	Dir      string
+	MaxBytes int64         // Uncompressed bytes per segment; zero means no limit
+	MaxAge   time.Duration // How long to write to a segment before rotating; zero means no limit
+
+	file      *os.File
+	encoder   *zstd.Encoder
+	path      string
+	written   int64
+	startedAt time.Time
+	lastSeq   int64
+}
+
+func NewSegmentWriter(dir string, maxBytes int64, maxAge time.Duration) (*SegmentWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Segments left over from a crash are readable up to where they were cut
+	// off, so we just finish them off
+	partials, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix+partialSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, partial := range partials {
+		log.Warnf("Finalizing incomplete segment %s", partial)
+		if err := os.Rename(partial, strings.TrimSuffix(partial, partialSuffix)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SegmentWriter{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		MaxAge:   maxAge,
+		lastSeq:  -1,
+	}, nil
+}
+
+func (w *SegmentWriter) Write(frame Frame) error {
+	if w.file != nil && w.shouldRotate() {
+		if err := w.finishSegment(); err != nil {
+			return err
+		}
+	}
+
+	if w.file == nil {
+		firstSeq := frame.Seq
+		if firstSeq < 0 {
+			firstSeq = w.lastSeq + 1
+		}
+		if err := w.startSegment(firstSeq); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 0, 3*binary.MaxVarintLen64)
+	header = binary.AppendVarint(header, frame.Seq)
+	header = binary.AppendVarint(header, frame.ReceivedAt.UnixNano())
+	header = binary.AppendUvarint(header, uint64(len(frame.Data)))
+
+	if _, err := w.encoder.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.encoder.Write(frame.Data); err != nil {
+		return err
+	}
+
+	w.written += int64(len(header) + len(frame.Data))
+	if frame.Seq >= 0 {
+		w.lastSeq = frame.Seq
+	}
+
+	return nil
+}
+
+func (w *SegmentWriter) shouldRotate() bool {
+	if w.MaxBytes > 0 && w.written >= w.MaxBytes {
+		return true
+	}
+	if w.MaxAge > 0 && time.Since(w.startedAt) >= w.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (w *SegmentWriter) startSegment(firstSeq int64) error {
+	w.path = filepath.Join(w.Dir, fmt.Sprintf("%020d%s", firstSeq, segmentSuffix))
+
+	file, err := os.Create(w.path + partialSuffix)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := zstd.NewWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	log.Infof("Writing to new segment %s", w.path)
+
+	w.file = file
+	w.encoder = encoder
+	w.written = 0
+	w.startedAt = time.Now()
+
+	return nil
+}
+
+func (w *SegmentWriter) finishSegment() error {
+	if err := w.encoder.Close(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	w.file = nil
+	w.encoder = nil
+
+	return os.Rename(w.path+partialSuffix, w.path)
+}
+
+// Close finishes the current segment (if any).
+func (w *SegmentWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.finishSegment()
+}
+
+// ListSegments returns the finished segments in a directory, in seq order.
+func ListSegments(dir string) ([]Segment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]Segment, 0, len(paths))
+	for _, path := range paths {
+		firstSeq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), segmentSuffix), 10, 64)
+		if err != nil {
+			log.Warnf("Skipping %s, since its name isn't a seq", path)
+			continue
+		}
+		segments = append(segments, Segment{Path: path, FirstSeq: firstSeq})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].FirstSeq < segments[j].FirstSeq
+	})
+
+	return segments, nil
+}
+
+// ReadSegments calls cb with every frame in dir whose seq is at least fromSeq,
+// in order. Frames without a seq are included if their segment is.
+func ReadSegments(ctx context.Context, dir string, fromSeq int64, cb func(Frame) error) error {
+	segments, err := ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	// Skip every segment that ends before fromSeq; i.e., every segment before
+	// the last one that starts at or before it
+	start := 0
+	for i, segment := range segments {
+		if segment.FirstSeq <= fromSeq {
+			start = i
+		}
+	}
+
+	for _, segment := range segments[start:] {
+		err := readSegment(ctx, segment.Path, func(frame Frame) error {
+			if frame.Seq >= 0 && frame.Seq < fromSeq {
+				return nil
+			}
+			return cb(frame)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastSeq returns the last seq recorded in dir, or -1 if there is none.
+func LastSeq(ctx context.Context, dir string) (int64, error) {
+	segments, err := ListSegments(dir)
+	if err != nil {
+		return -1, err
+	}
+
+	lastSeq := int64(-1)
+	// The last segment may only contain frames without a seq, so keep going
+	// back until we find one
+	for i := len(segments) - 1; i >= 0 && lastSeq < 0; i-- {
+		err := readSegment(ctx, segments[i].Path, func(frame Frame) error {
+			if frame.Seq > lastSeq {
+				lastSeq = frame.Seq
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	return lastSeq, nil
+}
+
+func readSegment(ctx context.Context, path string, cb func(Frame) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	r := bufio.NewReader(decoder)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		frame, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// A segment that was cut off by a crash ends in a partial frame;
+			// everything before it is still good
+			log.Warnf("Segment %s ends early: %+v", path, err)
+			return nil
+		}
+
+		if err := cb(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (frame Frame, err error) {
+	frame.Seq, err = binary.ReadVarint(r)
+	if err != nil {
+		return frame, err
+	}
+
+	receivedAt, err := binary.ReadVarint(r)
+	if err != nil {
+		return frame, unexpectedEOF(err)
+	}
+	frame.ReceivedAt = time.Unix(0, receivedAt)
+
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return frame, unexpectedEOF(err)
+	}
+
+	frame.Data = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return frame, unexpectedEOF(err)
+	}
+
+	return frame, nil
+}
+
+// Running out of data in the middle of a frame is never a clean end of segment
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recorder writes raw frames from a subscribeRepos endpoint to segments,
+// without decoding (or hydrating) anything beyond what it needs to find each
+// frame's seq.
+type Recorder struct {
+	// SocketURL is the full websocket path to the ATProto SubscribeRepos XRPC endpoint
+	SocketURL   *url.URL
+	Writer      *SegmentWriter
+	BackfillSeq int64
+}
+
+func (r *Recorder) BeginRecording(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var socketUrl string = r.SocketURL.String()
+	// If we're backfilling, add the backfill seq to the socket url
+	if r.BackfillSeq > 0 {
+		socketUrl = fmt.Sprintf("%s?cursor=%d", socketUrl, r.BackfillSeq)
+	}
+
+	log.Infof("Connecting to WebSocket at: %s", socketUrl)
+	c, _, err := websocket.DefaultDialer.Dial(socketUrl, http.Header{
+		"User-Agent": []string{"skyfall/1.0"},
+	})
+	if err != nil {
+		log.Infof("Failed to connect to websocket: %v", err)
+		return err
+	}
+	defer c.Close()
+
+	// Keep the connection alive, and close it when we're cancelled so that the
+	// read below returns
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
+					log.Warnf("Failed to ping: %v", err)
+				}
+			case <-ctx.Done():
+				c.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		mt, reader, err := c.NextReader()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if mt != websocket.BinaryMessage {
+			return fmt.Errorf("expected binary message from subscription endpoint")
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		frame := Frame{Seq: -1, ReceivedAt: time.Now(), Data: data}
+
+		var evt events.XRPCStreamEvent
+		if err := evt.Deserialize(bytes.NewReader(data)); err != nil {
+			log.Warnf("Failed to decode frame; recording it anyway: %+v", err)
+		} else {
+			frame.Seq = evt.Sequence()
+			if evt.Error != nil {
+				log.Errorf("Error frame from stream: %s: %s", evt.Error.Error, evt.Error.Message)
+			}
+		}
+
+		if err := r.Writer.Write(frame); err != nil {
+			return err
+		}
+
+		// Resume after the last frame we've got if we reconnect
+		if frame.Seq > 0 {
+			r.BackfillSeq = frame.Seq
+		}
+	}
+}
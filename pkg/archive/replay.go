@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/stream"
+)
+
+// Replayer feeds recorded frames back through a Stream, as if they had just
+// arrived from the relay. Frames are handled one at a time and in order, so
+// replaying the same segments always produces the same rows in the same order.
+type Replayer struct {
+	Dir     string
+	Stream  *stream.Stream
+	FromSeq int64   // First seq to replay
+	ToSeq   int64   // Last seq to replay; zero means replay everything
+	Speed   float64 // Multiple of real time to replay at (e.g., 2 for twice as fast); zero means as fast as possible
+}
+
+// Stops reading segments once we're past ToSeq
+var errDone = errors.New("reached the last seq to replay")
+
+func (r *Replayer) Replay(ctx context.Context) error {
+	var firstReceivedAt time.Time
+	var startedAt time.Time
+	replayed := 0
+
+	err := ReadSegments(ctx, r.Dir, r.FromSeq, func(frame Frame) error {
+		if r.ToSeq > 0 && frame.Seq > r.ToSeq {
+			return errDone
+		}
+
+		if r.Speed > 0 {
+			if firstReceivedAt.IsZero() {
+				firstReceivedAt = frame.ReceivedAt
+				startedAt = time.Now()
+			}
+
+			// Keep the same spacing between frames as when they were recorded
+			// (scaled by the speed)
+			due := startedAt.Add(time.Duration(float64(frame.ReceivedAt.Sub(firstReceivedAt)) / r.Speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		var evt events.XRPCStreamEvent
+		if err := evt.Deserialize(bytes.NewReader(frame.Data)); err != nil {
+			log.Warnf("Failed to decode recorded frame (seq %d): %+v", frame.Seq, err)
+			return nil
+		}
+
+		if err := r.Stream.HandleStreamEvent(ctx, &evt); err != nil {
+			log.Warnf("Failed to handle recorded frame (seq %d): %+v", frame.Seq, err)
+		}
+
+		replayed++
+		if replayed%10_000 == 0 {
+			log.Infof("Replayed %d frames (up to seq %d)", replayed, frame.Seq)
+		}
+
+		return nil
+	})
+	if err == errDone {
+		err = nil
+	}
+
+	log.Infof("Finished replaying %d frames", replayed)
+
+	return err
+}
@@ -6,41 +6,34 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/stanfordio/skyfall/pkg/utils"
 
-	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/xrpc"
 )
 
 type Authenticator struct {
-	Context            context.Context
-	RefreshTokenClient *xrpc.Client
-	Client             *xrpc.Client
+	Context   context.Context
+	Directory identity.Directory // Used to find the PDS to authenticate with
+	Store     *Store             // Where sessions are saved between runs; nil to always log in afresh
 }
 
 func MakeAuthenticator(ctx context.Context) (*Authenticator, error) {
 	a := Authenticator{
-		Context: ctx,
-		Client: &xrpc.Client{
-			Client: utils.RetryingHTTPClient(),
-		},
-		RefreshTokenClient: &xrpc.Client{
-			Client: utils.RetryingHTTPClientExcept429(),
-		},
+		Context:   ctx,
+		Directory: identity.DefaultDirectory(),
 	}
 
 	return &a, nil
 }
 
-func findPersonalDataServerEndpoint(identifier string) (string, error) {
+func (a *Authenticator) findPersonalDataServerEndpoint(identifier string) (string, error) {
 	resolvedIdentifier, error := syntax.ParseAtIdentifier(identifier)
 	if error != nil {
 		return "", error
 	}
 
-	identity, err := identity.DefaultDirectory().Lookup(context.TODO(), *resolvedIdentifier)
+	identity, err := a.Directory.Lookup(a.Context, *resolvedIdentifier)
 	if err != nil {
 		return "", err
 	}
@@ -57,9 +50,16 @@ func findPersonalDataServerEndpoint(identifier string) (string, error) {
 	return endpoint, nil
 }
 
-func (a *Authenticator) Authenticate(identifier string, password string) (*xrpc.AuthInfo, error) {
+// Authenticate logs in (or picks up the session saved from a previous run) and
+// keeps the session refreshed for as long as the authenticator's context lasts.
+func (a *Authenticator) Authenticate(identifier string, password string) (*Session, error) {
+	if session, ok := a.resume(identifier, password); ok {
+		go session.keepRefreshed(a.Context)
+		return session, nil
+	}
+
 	// First we need to lookup where we authenticate; then we authenticate there
-	pdsEndpoint, err := findPersonalDataServerEndpoint(identifier)
+	pdsEndpoint, err := a.findPersonalDataServerEndpoint(identifier)
 	if err != nil {
 		return nil, err
 	}
@@ -67,58 +67,46 @@ func (a *Authenticator) Authenticate(identifier string, password string) (*xrpc.
 	// Print/format the pds endpoint
 	log.Infof("Authenticating with PDS endpoint: %s", pdsEndpoint)
 
-	// Set the host to the PDS endpoint
-	a.Client.Host = pdsEndpoint
-
 	// Hit the PDS endpoint to authenticate
-	output, err := atproto.ServerCreateSession(a.Context, a.Client, &atproto.ServerCreateSession_Input{
-		Identifier: identifier,
-		Password:   password,
-	})
-
-	if err != nil {
+	session := newSession(identifier, password, pdsEndpoint, xrpc.AuthInfo{}, a.Store)
+	if err := session.login(a.Context); err != nil {
 		return nil, err
 	}
 
-	info := xrpc.AuthInfo{
-		AccessJwt:  output.AccessJwt,
-		RefreshJwt: output.RefreshJwt,
-		Did:        output.Did,
-		Handle:     output.Handle,
-	}
-	a.RefreshTokenClient.Host = pdsEndpoint
-
 	// Start a goroutine to refresh the token
-	go a.refreshTokenContinuously(&info)
-	return &info, nil
+	go session.keepRefreshed(a.Context)
+	return session, nil
 }
 
-func (a *Authenticator) refreshTokenContinuously(authInfo *xrpc.AuthInfo) {
-	// Put the refresh token into the access token slot. Janky, but this is what Bluesky expects.
-	// We intentionally create a new AuthInfo here.
-
-	// Send a refresh request every minute
-	for {
-		a.RefreshTokenClient.Auth = &xrpc.AuthInfo{
-			AccessJwt: authInfo.RefreshJwt,
-			Did:       authInfo.Did,
-			Handle:    authInfo.Handle,
-		}
+// resume picks up the session saved for the account, if there is one that's
+// still good. If its access token has (nearly) expired, it's refreshed first.
+func (a *Authenticator) resume(identifier string, password string) (*Session, bool) {
+	if a.Store == nil {
+		return nil, false
+	}
 
-		out, error := atproto.ServerRefreshSession(a.Context, a.RefreshTokenClient)
+	stored, ok := a.Store.get(identifier)
+	if !ok {
+		return nil, false
+	}
+	if expiry, ok := tokenExpiry(stored.RefreshJwt); ok && time.Now().After(expiry) {
+		log.Infof("Saved session for %s has expired", identifier)
+		return nil, false
+	}
 
-		if error != nil {
-			log.Errorf("Error refreshing token: %+v; this is typically catastrophic, but I'll try again in 15 seconds...", error)
-			time.Sleep(15 * time.Second)
-			continue
-		} else {
-			log.Debugf("Successfully refreshed access token")
+	session := newSession(identifier, password, stored.PDSEndpoint, xrpc.AuthInfo{
+		AccessJwt:  stored.AccessJwt,
+		RefreshJwt: stored.RefreshJwt,
+		Did:        stored.Did,
+		Handle:     stored.Handle,
+	}, a.Store)
+	if session.untilRefresh() <= 0 {
+		if err := session.refresh(a.Context); err != nil {
+			log.Warnf("Failed to refresh saved session for %s: %+v", identifier, err)
+			return nil, false
 		}
-
-		// Update the access token for everyone else
-		authInfo.AccessJwt = out.AccessJwt
-		authInfo.RefreshJwt = out.RefreshJwt
-
-		time.Sleep(60 * time.Second)
 	}
+
+	log.Infof("Resumed saved session for %s at %s", identifier, stored.PDSEndpoint)
+	return session, true
 }
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/hostlimit"
+)
+
+// How long to stop using an account that gets a 401 (e.g., because its access
+// token was revoked; the session is refreshed straight away, too), or a 429
+// that doesn't say when the limit resets. Accounts are retired for at least
+// minimumRetirement, even if a 429 says the limit has already reset, so that
+// they aren't picked again straight away.
+const (
+	unauthorizedRetirement = time.Minute
+	rateLimitedRetirement  = 5 * time.Minute
+	minimumRetirement      = 5 * time.Second
+)
+
+// Credential is one line of a credentials file, e.g.,
+// {"handle": "alice.bsky.social", "password": "abcd-efgh-ijkl-mnop"}. App
+// passwords are recommended.
+type Credential struct {
+	Handle   string `json:"handle"`
+	Password string `json:"password"`
+}
+
+// LoadCredentials reads a credentials file, with one JSON-encoded Credential
+// per line.
+func LoadCredentials(path string) ([]Credential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var credentials []Credential
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var credential Credential
+		if err := json.Unmarshal([]byte(text), &credential); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if credential.Handle == "" || credential.Password == "" {
+			return nil, fmt.Errorf("%s:%d: expected a handle and a password", path, line)
+		}
+		credentials = append(credentials, credential)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", path)
+	}
+
+	return credentials, nil
+}
+
+// Pool spreads authenticated requests across several sessions, taking turns.
+// Accounts that start getting turned away (401s or 429s) are retired for a
+// while, and the others pick up the slack.
+//
+// An empty pool makes requests unauthenticated, and warns (once per host) if a
+// host turns them away for it.
+type Pool struct {
+	lk       sync.Mutex
+	sessions []*Session
+	next     int             // Index of the session whose turn is next
+	warned   map[string]bool // Hosts that turned away unauthenticated requests
+}
+
+func NewPool(sessions ...*Session) *Pool {
+	return &Pool{sessions: sessions, warned: make(map[string]bool)}
+}
+
+func (p *Pool) Len() int {
+	return len(p.sessions)
+}
+
+// pick returns the next session that isn't retired or, if they all are, the
+// one that will be back soonest (nil if the pool is empty). The bool is whether
+// the session is actually available.
+func (p *Pool) pick() (*Session, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if len(p.sessions) == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	var soonest *Session
+	for i := 0; i < len(p.sessions); i++ {
+		session := p.sessions[(p.next+i)%len(p.sessions)]
+		if session.retiredUntil.Before(now) {
+			p.next = (p.next + i + 1) % len(p.sessions)
+			return session, true
+		}
+		if soonest == nil || session.retiredUntil.Before(soonest.retiredUntil) {
+			soonest = session
+		}
+	}
+	return soonest, false
+}
+
+func (p *Pool) retire(session *Session, until time.Time, status int) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if earliest := time.Now().Add(minimumRetirement); until.Before(earliest) {
+		until = earliest
+	}
+
+	if until.After(session.retiredUntil) {
+		log.Warnf("Got a %d for %s, so not using it until %s", status, session.Handle(), until.Format(time.RFC3339))
+		session.retiredUntil = until
+	}
+}
+
+func (p *Pool) warnUnauthenticated(host string, path string) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if !p.warned[host] {
+		log.Warnf("%s requires authentication for %s; give credentials (e.g., a handle and password) to use it", host, path)
+		p.warned[host] = true
+	}
+}
+
+// Transport wraps an HTTP transport (nil for the default one) so that requests
+// through it are authenticated as the pool's sessions, in turn. Requests that
+// already carry an Authorization header are left alone.
+func (p *Pool) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{pool: p, next: next}
+}
+
+type transport struct {
+	pool *Pool
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	session, _ := t.pool.pick()
+	if session == nil {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode == http.StatusUnauthorized {
+			t.pool.warnUnauthenticated(req.URL.Host, req.URL.Path)
+		}
+		return resp, err
+	}
+
+	for attempts := 1; ; attempts++ {
+		resp, err := t.roundTripAs(session, req)
+		if err != nil || !t.retired(session, resp) {
+			return resp, err
+		}
+
+		// Go again straight away as another account, if there's one to spare
+		// (and the request can be sent again), trying each account at most once
+		next, ok := t.pool.pick()
+		if !ok || attempts >= t.pool.Len() || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		session = next
+	}
+}
+
+func (t *transport) roundTripAs(session *Session, req *http.Request) (*http.Response, error) {
+	info := session.AuthInfo()
+	req = req.Clone(hostlimit.WithAccount(req.Context(), info.Did))
+	req.Header.Set("Authorization", "Bearer "+info.AccessJwt)
+	return t.next.RoundTrip(req)
+}
+
+// retired retires the session if the response turned it away, and reports
+// whether it did.
+func (t *transport) retired(session *Session, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		t.pool.retire(session, time.Now().Add(unauthorizedRetirement), resp.StatusCode)
+		session.RefreshSoon()
+		return true
+	case http.StatusTooManyRequests:
+		until, ok := hostlimit.ResetTime(resp)
+		if !ok {
+			until = time.Now().Add(rateLimitedRetirement)
+		}
+		t.pool.retire(session, until, resp.StatusCode)
+		return true
+	default:
+		return false
+	}
+}
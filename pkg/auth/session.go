@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/utils"
+)
+
+const (
+	// How long before its access token expires that a session is refreshed
+	refreshMargin = 5 * time.Minute
+
+	// How often to refresh sessions whose access tokens don't say when they
+	// expire (e.g., because they aren't JWTs)
+	fallbackRefreshInterval = time.Minute
+
+	// Failed refreshes are retried with exponential backoff between these
+	minRetryInterval = 15 * time.Second
+	maxRetryInterval = 10 * time.Minute
+)
+
+// Session is a logged-in account, which keeps its own tokens fresh: they're
+// refreshed a little before the access token expires, and if the refresh token
+// has expired (or been revoked), the account logs in again from scratch.
+type Session struct {
+	lk           sync.Mutex
+	identifier   string        // What the account logs in as, e.g., its handle
+	password     string        // For logging in again once the refresh token is no good
+	info         xrpc.AuthInfo // Guarded by lk, since the refresher replaces it while requests read it
+	client       *xrpc.Client  // Pointed at the account's PDS
+	store        *Store        // Where the session is saved; nil if it isn't
+	refreshNow   chan struct{} // Nudges the refresher to refresh early (e.g., after a 401)
+	retiredUntil time.Time     // Set by the pool (and guarded by its lock) when the account is being turned away
+}
+
+func newSession(identifier string, password string, pdsEndpoint string, info xrpc.AuthInfo, store *Store) *Session {
+	return &Session{
+		identifier: identifier,
+		password:   password,
+		info:       info,
+		client: &xrpc.Client{
+			Client: utils.RetryingHTTPClientExcept429(),
+			Host:   pdsEndpoint,
+		},
+		store:      store,
+		refreshNow: make(chan struct{}, 1),
+	}
+}
+
+// AuthInfo is a copy of the session's current tokens.
+func (s *Session) AuthInfo() xrpc.AuthInfo {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.info
+}
+
+func (s *Session) Handle() string {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.info.Handle
+}
+
+// RefreshSoon asks the refresher to refresh the session now, rather than when
+// the access token is about to expire.
+func (s *Session) RefreshSoon() {
+	select {
+	case s.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// login creates a brand new session with the account's password.
+func (s *Session) login(ctx context.Context) error {
+	output, err := atproto.ServerCreateSession(ctx, s.client, &atproto.ServerCreateSession_Input{
+		Identifier: s.identifier,
+		Password:   s.password,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.update(xrpc.AuthInfo{
+		AccessJwt:  output.AccessJwt,
+		RefreshJwt: output.RefreshJwt,
+		Did:        output.Did,
+		Handle:     output.Handle,
+	})
+	return nil
+}
+
+// refresh swaps the refresh token for new tokens, falling back to logging in
+// again if the refresh token has expired or is otherwise no longer accepted.
+func (s *Session) refresh(ctx context.Context) error {
+	info := s.AuthInfo()
+	if expiry, ok := tokenExpiry(info.RefreshJwt); ok && time.Now().After(expiry) {
+		log.Infof("Refresh token for %s has expired, so logging in again", info.Handle)
+		return s.login(ctx)
+	}
+
+	// Put the refresh token into the access token slot. Janky, but this is what
+	// Bluesky expects. We intentionally create a new client here.
+	client := *s.client
+	client.Auth = &xrpc.AuthInfo{
+		AccessJwt: info.RefreshJwt,
+		Did:       info.Did,
+		Handle:    info.Handle,
+	}
+
+	out, err := atproto.ServerRefreshSession(ctx, &client)
+	if isRejectedToken(err) {
+		log.Infof("Refresh token for %s was rejected (%v), so logging in again", info.Handle, err)
+		return s.login(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.update(xrpc.AuthInfo{
+		AccessJwt:  out.AccessJwt,
+		RefreshJwt: out.RefreshJwt,
+		Did:        out.Did,
+		Handle:     out.Handle,
+	})
+	return nil
+}
+
+// update swaps in new tokens (for everyone else) and saves them.
+func (s *Session) update(info xrpc.AuthInfo) {
+	s.lk.Lock()
+	s.info = info
+	s.lk.Unlock()
+
+	if s.store != nil {
+		if err := s.store.put(s.identifier, storedSession{
+			Did:         info.Did,
+			Handle:      info.Handle,
+			PDSEndpoint: s.client.Host,
+			AccessJwt:   info.AccessJwt,
+			RefreshJwt:  info.RefreshJwt,
+		}); err != nil {
+			log.Errorf("Failed to save session for %s: %+v", info.Handle, err)
+		}
+	}
+}
+
+// untilRefresh is how long until the access token is due to be refreshed.
+func (s *Session) untilRefresh() time.Duration {
+	expiry, ok := tokenExpiry(s.AuthInfo().AccessJwt)
+	if !ok {
+		return fallbackRefreshInterval
+	}
+	return time.Until(expiry.Add(-refreshMargin))
+}
+
+// keepRefreshed refreshes the session whenever it's due (or asked to), until
+// the context is cancelled.
+func (s *Session) keepRefreshed(ctx context.Context) {
+	retryInterval := minRetryInterval
+	failing := false
+	for {
+		wait := s.untilRefresh()
+		if failing {
+			wait = retryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.refreshNow:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		if err := s.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if failing {
+				retryInterval = min(retryInterval*2, maxRetryInterval)
+			}
+			failing = true
+			log.Errorf("Failed to refresh session for %s: %+v; trying again in %s", s.Handle(), err, retryInterval)
+			continue
+		}
+
+		log.Debugf("Successfully refreshed session for %s", s.Handle())
+		failing = false
+		retryInterval = minRetryInterval
+	}
+}
+
+// isRejectedToken reports whether a refresh failed because the PDS won't take
+// the refresh token anymore (rather than, e.g., a network error).
+func isRejectedToken(err error) bool {
+	var xrpcErr *xrpc.XRPCError
+	if !errors.As(err, &xrpcErr) {
+		return false
+	}
+	return xrpcErr.ErrStr == "ExpiredToken" || xrpcErr.ErrStr == "InvalidToken"
+}
+
+// tokenExpiry reads the expiry (exp claim) of a JWT, without verifying it.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps sessions in a file, so that they can be picked up again after a
+// restart instead of logging in afresh every time. The file holds live tokens,
+// so it's only readable by its owner.
+type Store struct {
+	lk       sync.Mutex
+	path     string
+	sessions map[string]storedSession // Keyed by what each account logs in as
+}
+
+type storedSession struct {
+	Did         string `json:"did"`
+	Handle      string `json:"handle"`
+	PDSEndpoint string `json:"pdsEndpoint"`
+	AccessJwt   string `json:"accessJwt"`
+	RefreshJwt  string `json:"refreshJwt"`
+}
+
+// OpenStore loads the sessions saved at path, if there are any.
+func OpenStore(path string) (*Store, error) {
+	st := &Store{path: path, sessions: make(map[string]storedSession)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.sessions); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (st *Store) get(identifier string) (storedSession, bool) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	session, ok := st.sessions[identifier]
+	return session, ok
+}
+
+// put saves a session, replacing the file so that it's never left half-written.
+func (st *Store) put(identifier string, session storedSession) error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+
+	st.sessions[identifier] = session
+	data, err := json.MarshalIndent(st.sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
@@ -0,0 +1,228 @@
+package breaker
+
+// Per-host circuit breakers. After enough consecutive failures (transport
+// errors or 5xx responses), a host's breaker opens, and requests to it fail
+// right away with ErrOpen instead of waiting on timeouts and retries. Once the
+// cooldown is over, the breaker half-opens and lets a single request through
+// to probe the host: if it succeeds, the breaker closes again; if not, it
+// reopens for another cooldown.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/hostlimit"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+)
+
+const (
+	DefaultFailures = 5
+	DefaultCooldown = time.Minute
+)
+
+// Returned (wrapped) for requests to hosts whose breaker is open
+var ErrOpen = errors.New("circuit breaker open")
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Shared is used by every HTTP client that utils makes, so that all requests
+// to a host count towards (and are stopped by) the same breaker.
+var Shared = NewBreakers(DefaultFailures, DefaultCooldown)
+
+type Breakers struct {
+	lk       sync.Mutex
+	failures int           // Consecutive failures that open a breaker; zero disables breakers
+	cooldown time.Duration // How long a breaker stays open before probing
+	hosts    map[string]*host
+}
+
+type host struct {
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool // Whether the half-open probe is in flight
+}
+
+func NewBreakers(failures int, cooldown time.Duration) *Breakers {
+	return &Breakers{
+		failures: failures,
+		cooldown: cooldown,
+		hosts:    make(map[string]*host),
+	}
+}
+
+func (b *Breakers) Configure(failures int, cooldown time.Duration) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.failures = failures
+	b.cooldown = cooldown
+}
+
+// Cooldown is how long an open breaker waits before probing its host.
+func (b *Breakers) Cooldown() time.Duration {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.cooldown
+}
+
+// Callers must hold b.lk.
+func (b *Breakers) host(name string) *host {
+	h, ok := b.hosts[name]
+	if !ok {
+		h = &host{}
+		b.hosts[name] = h
+	}
+	return h
+}
+
+// Callers must hold b.lk.
+func (b *Breakers) transition(name string, h *host, state State) {
+	if h.state == state {
+		return
+	}
+	log.Warnf("Circuit breaker for %s is now %s (was %s)", name, state, h.state)
+	h.state = state
+	metrics.BreakerState.WithLabelValues(name).Set(float64(state))
+}
+
+// IsOpen reports whether requests to the host would currently fail fast.
+func (b *Breakers) IsOpen(name string) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	h, ok := b.hosts[name]
+	if !ok {
+		return false
+	}
+	return h.state == Open && time.Since(h.openedAt) < b.cooldown
+}
+
+// Allow reports whether a request to the host may go. If it returns true, the
+// caller must report how the request went with Done.
+func (b *Breakers) Allow(name string) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.failures <= 0 {
+		return true
+	}
+
+	h := b.host(name)
+	switch h.state {
+	case Open:
+		if time.Since(h.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(name, h, HalfOpen)
+		h.probing = true
+		return true
+	case HalfOpen:
+		// Only one probe at a time
+		if h.probing {
+			return false
+		}
+		h.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Done records whether a request that was allowed succeeded.
+func (b *Breakers) Done(name string, success bool) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.failures <= 0 {
+		return
+	}
+
+	h := b.host(name)
+	if success {
+		h.failures = 0
+		h.probing = false
+		b.transition(name, h, Closed)
+		return
+	}
+
+	h.failures++
+	if h.state == HalfOpen || h.failures >= b.failures {
+		h.probing = false
+		h.openedAt = time.Now()
+		b.transition(name, h, Open)
+	}
+}
+
+// Release ends a request that was allowed without saying anything about the
+// host (e.g., because it was cancelled), so that if it was the half-open probe,
+// another request can probe instead.
+func (b *Breakers) Release(name string) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if h, ok := b.hosts[name]; ok {
+		h.probing = false
+	}
+}
+
+// Transport wraps an HTTP transport (nil for the default one) with the
+// breakers. Transport errors and 5xx responses count as failures; anything else
+// (including 4xx responses, which say more about the request than the host)
+// counts as a success, except for requests that were cancelled or never sent
+// (see hostlimit.ErrWaiting), which don't count either way.
+func (b *Breakers) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{breakers: b, next: next}
+}
+
+type transport struct {
+	breakers *Breakers
+	next     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := req.URL.Host
+	if !t.breakers.Allow(name) {
+		metrics.BreakerRejected.WithLabelValues(name).Inc()
+		return nil, fmt.Errorf("%s: %w", name, ErrOpen)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, hostlimit.ErrWaiting)):
+		// Says nothing about the host (if we gave up waiting for its rate
+		// limit, the request was never even sent)
+		t.breakers.Release(name)
+	case err != nil:
+		t.breakers.Done(name, false)
+	default:
+		t.breakers.Done(name, resp.StatusCode < 500)
+	}
+	return resp, err
+}
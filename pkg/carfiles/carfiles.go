@@ -0,0 +1,174 @@
+package carfiles
+
+// Finds and reads repo CARs for hydration. An input is a .car file (optionally
+// compressed as .car.zst or .car.gz), a tar archive of them (.tar, .tar.gz,
+// .tgz or .tar.zst), or a folder containing any of these (possibly nested).
+// CARs are streamed from disk rather than read into memory first.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Source is a single repo CAR, either a file on disk or an entry in a tar
+// archive.
+type Source struct {
+	Name string // The file's path, or the archive's path joined with the entry's name
+
+	path string     // Set for files, which are read when loaded
+	repo *repo.Repo // Set for archive entries, which have to be read as the archive is walked
+}
+
+// Load reads the source's repo. Files are streamed from disk (and decompressed
+// on the fly), so only the repo's blocks are held in memory.
+func (s Source) Load(ctx context.Context) (*repo.Repo, error) {
+	if s.repo != nil {
+		return s.repo, nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := decompress(s.path, file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return repo.ReadRepoFromCar(ctx, r)
+}
+
+// IsCAR reports whether a file name looks like a (possibly compressed) CAR.
+func IsCAR(name string) bool {
+	return strings.HasSuffix(name, ".car") || strings.HasSuffix(name, ".car.zst") || strings.HasSuffix(name, ".car.gz")
+}
+
+// IsArchive reports whether a file name looks like a (possibly compressed) tar
+// archive.
+func IsArchive(name string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".tar.zst"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps r in a decompressor, based on name's suffix.
+func decompress(name string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		return gzip.NewReader(r)
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// Walk sends every CAR in input to sources, in order, skipping those whose
+// names skip returns true for. Archive entries are read here (one at a time),
+// while files are left for whoever receives the source to load.
+func Walk(ctx context.Context, input string, skip func(name string) bool, sources chan<- Source) error {
+	send := func(source Source) error {
+		select {
+		case sources <- source:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		switch {
+		case IsCAR(path):
+			if skip(path) {
+				return nil
+			}
+			return send(Source{Name: path, path: path})
+		case IsArchive(path):
+			return walkArchive(ctx, path, skip, send)
+		default:
+			return nil
+		}
+	})
+}
+
+func walkArchive(ctx context.Context, path string, skip func(name string) bool, send func(Source) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := decompress(path, file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %w", path, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || !IsCAR(header.Name) {
+			continue
+		}
+
+		name := filepath.Join(path, header.Name)
+		if skip(name) {
+			continue
+		}
+
+		entry, err := decompress(header.Name, tr)
+		if err != nil {
+			log.Errorf("Failed to read %s: %+v", name, err)
+			continue
+		}
+		repo, err := repo.ReadRepoFromCar(ctx, entry)
+		entry.Close()
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			log.Errorf("Failed to read repo from %s: %+v", name, err)
+			continue
+		}
+
+		if err := send(Source{Name: name, repo: repo}); err != nil {
+			return err
+		}
+	}
+}
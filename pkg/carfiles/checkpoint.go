@@ -0,0 +1,66 @@
+package carfiles
+
+import (
+	"bufio"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint keeps track of which sources have been fully hydrated, so that an
+// interrupted run can pick up where it left off. It's a plain text file with one
+// source name per line, appended to as sources finish.
+type Checkpoint struct {
+	lk   sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{done: make(map[string]bool)}
+
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			if name := scanner.Text(); name != "" {
+				c.done[name] = true
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		log.Infof("Resuming from checkpoint %s, with %d sources already done", path, len(c.done))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+
+	return c, nil
+}
+
+// Done reports whether a source was marked done (in this run or a previous one).
+func (c *Checkpoint) Done(name string) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.done[name]
+}
+
+func (c *Checkpoint) MarkDone(name string) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.done[name] = true
+	_, err := c.file.WriteString(name + "\n")
+	return err
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
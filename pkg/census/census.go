@@ -1,7 +1,18 @@
 package census
 
-// The census command is so simple that we just put the implementation in
-// `main.go` for now. If it grows, we can move it here.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/output/dedup"
+	"github.com/stanfordio/skyfall/pkg/utils"
+)
 
 type CensusFileEntry struct {
 	// The DID of the file
@@ -9,3 +20,85 @@ type CensusFileEntry struct {
 	Head string
 	Rev  string
 }
+
+// Take lists all the users on the network, then for each one writes a JSON
+// line with the user's DID and some basic metadata to out. The output can be
+// fed to the pull command to pull all the data from all the users on the
+// network, with hydration.
+//
+// If more than one endpoint is given (e.g., the relay plus self-hosted PDSes),
+// each DID is only written once. The DIDs seen so far are kept in a set on
+// disk (in a temporary directory that's removed afterwards), since there can be
+// far too many to hold in memory.
+func Take(ctx context.Context, pdsEndpoints []string, out io.Writer) error {
+	var seen *dedup.DiskSet
+	if len(pdsEndpoints) > 1 {
+		dir, err := os.MkdirTemp("", "skyfall-census-")
+		if err != nil {
+			return fmt.Errorf("failed to make a directory for the DIDs seen: %w", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Unbounded, so that no DID is forgotten
+		seen, err = dedup.OpenDiskSet(dir, 0)
+		if err != nil {
+			return err
+		}
+		defer seen.Close()
+	}
+
+	for _, pdsEndpoint := range pdsEndpoints {
+		xrpcClient := &xrpc.Client{
+			Client: utils.RetryingHTTPClient(),
+			Host:   pdsEndpoint,
+		}
+
+		cursor := ""
+
+		for {
+			list, err := comatproto.SyncListRepos(ctx, xrpcClient, cursor, 1000)
+			if err != nil {
+				return fmt.Errorf("failed to get list of repos from %s: %w", pdsEndpoint, err)
+			}
+			log.Infof("Got %d repos from %s (cursor = %s)", len(list.Repos), pdsEndpoint, cursor)
+
+			for _, r := range list.Repos {
+				if seen != nil {
+					duplicate, err := seen.Contains([]byte(r.Did))
+					if err != nil {
+						return fmt.Errorf("failed to look up %s in the DIDs seen: %w", r.Did, err)
+					}
+					if duplicate {
+						continue
+					}
+					if err := seen.Add([]byte(r.Did)); err != nil {
+						return fmt.Errorf("failed to add %s to the DIDs seen: %w", r.Did, err)
+					}
+				}
+
+				data := CensusFileEntry{
+					Did:  r.Did,
+					Rev:  r.Rev,
+					Head: r.Head,
+				}
+
+				// Marshall + write to file, with newline
+				marshalled, err := json.Marshal(data)
+				if err != nil {
+					return err
+				}
+				if _, err := out.Write(append(marshalled, '\n')); err != nil {
+					return err
+				}
+			}
+
+			if len(list.Repos) == 0 || list.Cursor == nil {
+				log.Infof("Finished pulling DIDs from: %s", pdsEndpoint)
+				break
+			}
+			cursor = *list.Cursor
+		}
+	}
+
+	return nil
+}
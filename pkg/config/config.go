@@ -0,0 +1,310 @@
+package config
+
+// Config files and environment variables for every flag. A config file (YAML,
+// or TOML) sets global flags at its top level, and each command's flags in a
+// section named after the command, e.g.,
+//
+//	rate-limit: 100
+//	host-rate-limit: [public.api.bsky.app=50]
+//	stream:
+//	  output-bq-table: dgap_bsky.example_table
+//	  hydration-collection: [app.bsky.feed.like=none]
+//
+// Every flag can also be set with an environment variable: SKYFALL_ and the
+// flag's name for global flags (e.g., SKYFALL_RATE_LIMIT), or SKYFALL_, the
+// command's name and the flag's name for command flags (e.g.,
+// SKYFALL_STREAM_OUTPUT_FILE). Flags on the command line win over environment
+// variables, which win over the config file, which wins over the defaults.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "SKYFALL"
+
+// Redacted stands in for secrets when the effective config is described
+const Redacted = "<redacted>"
+
+type Config struct {
+	path     string
+	global   map[string]interface{}
+	sections map[string]map[string]interface{} // By command
+}
+
+// Load reads a config file (.yaml, .yml, .json or .toml) and checks it against
+// the app's flags, so that typos are caught rather than ignored. Since flags
+// can't be missing once the file sets them, flags it sets are no longer
+// required on the command line.
+func Load(path string, app *cli.App) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format (expected .yaml, .yml, .json or .toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	config := &Config{
+		path:     path,
+		global:   make(map[string]interface{}),
+		sections: make(map[string]map[string]interface{}),
+	}
+	for key, value := range values {
+		// Command sections are tables; anything else is a global flag (which
+		// matters for identity-history, which is both)
+		section, isSection := value.(map[string]interface{})
+		if command := findCommand(app, key); command != nil && isSection {
+			for name := range section {
+				if findFlag(command.Flags, name) == nil {
+					return nil, fmt.Errorf("%s: unknown setting %s.%s", path, key, name)
+				}
+			}
+			config.sections[command.Name] = section
+			continue
+		}
+		if findFlag(app.Flags, key) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+		config.global[key] = value
+	}
+
+	for name, section := range config.sections {
+		command := findCommand(app, name)
+		for key := range section {
+			if _, required, ok := fields(findFlag(command.Flags, key)); ok {
+				*required = false
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Apply sets flags (the app's, for an empty section, or a command's) from the
+// config file, unless they were given on the command line or in the
+// environment. It's a no-op on a nil Config, i.e., when there's no config file.
+func (c *Config) Apply(cctx *cli.Context, section string, flags []cli.Flag) error {
+	if c == nil {
+		return nil
+	}
+
+	values := c.global
+	prefix := ""
+	if section != "" {
+		values = c.sections[section]
+		prefix = section + "."
+	}
+
+	for key, value := range values {
+		flag := findFlag(flags, key)
+		name := flag.Names()[0]
+		if cctx.IsSet(name) {
+			continue
+		}
+
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		} else if _, ok := flag.(*cli.StringSliceFlag); !ok {
+			return fmt.Errorf("%s: %s%s takes a single value, not a list", c.path, prefix, key)
+		}
+		for _, item := range list {
+			text, err := toString(item)
+			if err != nil {
+				return fmt.Errorf("%s: %s%s: %w", c.path, prefix, key, err)
+			}
+			if err := cctx.Set(name, text); err != nil {
+				return fmt.Errorf("%s: invalid value for %s%s: %w", c.path, prefix, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func toString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(value), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// AddEnvVars gives every flag (the app's and its commands') an environment
+// variable, ahead of any it already has.
+func AddEnvVars(app *cli.App) {
+	for _, flag := range app.Flags {
+		addEnvVar(flag, envPrefix)
+	}
+	for _, command := range app.Commands {
+		for _, flag := range command.Flags {
+			addEnvVar(flag, envPrefix+"_"+envName(command.Name))
+		}
+	}
+}
+
+func addEnvVar(flag cli.Flag, prefix string) {
+	envVars, _, ok := fields(flag)
+	if !ok {
+		return
+	}
+	*envVars = append([]string{prefix + "_" + envName(flag.Names()[0])}, *envVars...)
+}
+
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// fields returns the parts of a flag that config changes.
+func fields(flag cli.Flag) (envVars *[]string, required *bool, ok bool) {
+	switch flag := flag.(type) {
+	case *cli.StringFlag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.BoolFlag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.IntFlag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.Int64Flag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.Float64Flag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.DurationFlag:
+		return &flag.EnvVars, &flag.Required, true
+	case *cli.StringSliceFlag:
+		return &flag.EnvVars, &flag.Required, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// Describe is the effective config of a running command (global flags, then the
+// command's), as a (single-line) YAML config file that would reproduce it. Flags whose names
+// suggest secrets (passwords, tokens, ...) are redacted.
+func Describe(cctx *cli.Context) (string, error) {
+	// Lookups fall back to the parent contexts, so global flags can be read
+	// from the command's context
+	global, err := describeFlags(cctx, cctx.App.Flags)
+	if err != nil {
+		return "", err
+	}
+	command, err := describeFlags(cctx, cctx.Command.Flags)
+	if err != nil {
+		return "", err
+	}
+	global.Content = append(global.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: cctx.Command.Name}, command)
+
+	// On one line, so that it's one log entry
+	global.Style = yaml.FlowStyle
+	out, err := yaml.Marshal(global)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func describeFlags(cctx *cli.Context, flags []cli.Flag) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		if !describable(name) {
+			continue
+		}
+
+		var value yaml.Node
+		if err := value.Encode(effective(cctx, flag)); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, &value)
+	}
+	return node, nil
+}
+
+func effective(cctx *cli.Context, flag cli.Flag) interface{} {
+	name := flag.Names()[0]
+	switch flag.(type) {
+	case *cli.StringFlag:
+		if value := cctx.String(name); value == "" || !secret(name) {
+			return value
+		}
+		return Redacted
+	case *cli.BoolFlag:
+		return cctx.Bool(name)
+	case *cli.IntFlag:
+		return cctx.Int(name)
+	case *cli.Int64Flag:
+		return cctx.Int64(name)
+	case *cli.Float64Flag:
+		return cctx.Float64(name)
+	case *cli.DurationFlag:
+		return cctx.Duration(name).String()
+	case *cli.StringSliceFlag:
+		if values := cctx.StringSlice(name); values != nil {
+			return values
+		}
+		return []string{}
+	default:
+		if secret(name) {
+			return Redacted
+		}
+		return fmt.Sprint(cctx.Value(name))
+	}
+}
+
+func secret(name string) bool {
+	for _, word := range []string{"password", "secret", "token"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Help, the version and the config file itself aren't settings
+func describable(name string) bool {
+	return name != "help" && name != "version" && name != "config"
+}
+
+func findCommand(app *cli.App, name string) *cli.Command {
+	for _, command := range app.Commands {
+		if command.Name == name && command.Name != "help" {
+			return command
+		}
+	}
+	return nil
+}
+
+func findFlag(flags []cli.Flag, name string) cli.Flag {
+	if !describable(name) {
+		return nil
+	}
+	for _, flag := range flags {
+		for _, alias := range flag.Names() {
+			if alias == name {
+				return flag
+			}
+		}
+	}
+	return nil
+}
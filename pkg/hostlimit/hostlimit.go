@@ -0,0 +1,321 @@
+package hostlimit
+
+// Per-host rate limiting. Every host (the AppView, the relay, each PDS, the PLC
+// directory, ...) gets its own budget, so that a slow or strict host doesn't
+// hold up requests to the others. Requests are paced at a configured rate, and
+// once a host tells us its limits (through RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers, as Bluesky's services send), the remaining
+// budget is spread out evenly until the window resets, so that we slow down
+// ahead of running out rather than after getting a 429. Those budgets are kept
+// per account, since hosts count authenticated requests against the account
+// making them.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+)
+
+// Requests per second to each host that doesn't have its own rate
+const DefaultRate = 1000
+
+// Returned (wrapped, along with the context's error) for requests that were
+// given up on while waiting for their host's budget, so never sent
+var ErrWaiting = errors.New("gave up waiting for the host's rate limit")
+
+// Shared is used by every HTTP client that utils makes, so that budgets are
+// per host rather than per client.
+var Shared = NewLimits(DefaultRate)
+
+type Limits struct {
+	lk          sync.Mutex
+	defaultRate float64
+	rates       map[string]float64 // Per-host overrides
+	hosts       map[string]*host
+}
+
+type host struct {
+	lk       sync.Mutex
+	interval time.Duration // Between requests, at the configured rate
+	next     time.Time     // When the next request may go
+	budgets  map[string]*budget
+}
+
+// What the host reports about a rate limit window. Hosts may count requests per
+// account (see WithAccount) rather than per client, so each account gets its
+// own budget; unauthenticated requests share one.
+type budget struct {
+	next      time.Time // When the next request may go, pacing the budget
+	remaining int64     // Requests left in the current window, per the host (-1 if unknown)
+	reset     time.Time // When the current window ends
+}
+
+// Callers must hold h.lk.
+func (h *host) budget(account string) *budget {
+	b, ok := h.budgets[account]
+	if !ok {
+		b = &budget{remaining: -1}
+		h.budgets[account] = b
+	}
+	return b
+}
+
+type accountKey struct{}
+
+// WithAccount marks a request's context as being made as the given account
+// (e.g., its DID), so that the budgets hosts report are tracked per account.
+func WithAccount(ctx context.Context, account string) context.Context {
+	return context.WithValue(ctx, accountKey{}, account)
+}
+
+func accountFrom(ctx context.Context) string {
+	account, _ := ctx.Value(accountKey{}).(string)
+	return account
+}
+
+func NewLimits(defaultRate float64) *Limits {
+	return &Limits{
+		defaultRate: defaultRate,
+		rates:       make(map[string]float64),
+		hosts:       make(map[string]*host),
+	}
+}
+
+// Configure sets the default rate, plus overrides for particular hosts (e.g.,
+// public.api.bsky.app). Rates are in requests per second; zero means no limit
+// (other than what hosts report).
+func (l *Limits) Configure(defaultRate float64, rates map[string]float64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	l.defaultRate = defaultRate
+	l.rates = rates
+	for name, h := range l.hosts {
+		h.lk.Lock()
+		h.interval = l.intervalFor(name)
+		h.lk.Unlock()
+	}
+}
+
+// SetDefaultHostRate sets the rate for a host, unless Configure already set
+// one for it.
+func (l *Limits) SetDefaultHostRate(name string, rate float64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if _, ok := l.rates[name]; ok {
+		return
+	}
+	l.rates[name] = rate
+	if h, ok := l.hosts[name]; ok {
+		h.lk.Lock()
+		h.interval = l.intervalFor(name)
+		h.lk.Unlock()
+	}
+}
+
+// Callers must hold l.lk.
+func (l *Limits) intervalFor(name string) time.Duration {
+	rate, ok := l.rates[name]
+	if !ok {
+		rate = l.defaultRate
+	}
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func (l *Limits) host(name string) *host {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{interval: l.intervalFor(name), budgets: make(map[string]*budget)}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// Wait blocks until a request to the host may go.
+func (l *Limits) Wait(ctx context.Context, name string) error {
+	h := l.host(name)
+
+	h.lk.Lock()
+	b := h.budget(accountFrom(ctx))
+	now := time.Now()
+	at := h.next
+	if at.Before(now) {
+		at = now
+	}
+	if b.next.After(at) {
+		at = b.next
+	}
+
+	var paced time.Duration
+	spent := false // Whether we took one of the requests the host said were left
+	reset := b.reset
+	if b.remaining >= 0 && b.reset.After(at) {
+		if b.remaining == 0 {
+			// Out of budget, so wait for the window to reset
+			at = b.reset
+		} else {
+			// Spread what's left over the rest of the window
+			paced = b.reset.Sub(at) / time.Duration(b.remaining+1)
+		}
+		if b.remaining > 0 {
+			b.remaining--
+			spent = true
+		}
+	}
+	interval := h.interval
+	h.next = at.Add(interval)
+	if paced > 0 {
+		b.next = at.Add(paced)
+	}
+	h.lk.Unlock()
+
+	wait := time.Until(at)
+	metrics.RateLimitWait.WithLabelValues(name).Observe(wait.Seconds())
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the slot back, so that requests that were given up on don't
+		// hold up the ones queued after them (which keep their places; the
+		// next to arrive can just go that much sooner)
+		h.lk.Lock()
+		h.next = h.next.Add(-interval)
+		b.next = b.next.Add(-paced)
+		if spent && b.reset.Equal(reset) {
+			b.remaining++
+		}
+		h.lk.Unlock()
+		return fmt.Errorf("%w: %w", ErrWaiting, ctx.Err())
+	}
+}
+
+// Observe updates the host's budget (for the account the request was made as)
+// from a response's rate limit headers (and Retry-After, for 429s).
+func (l *Limits) Observe(ctx context.Context, name string, resp *http.Response) {
+	reset, ok := ResetTime(resp)
+	remaining, hasRemaining := parseInt(resp.Header.Get("RateLimit-Remaining"))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		remaining, hasRemaining = 0, true
+	}
+
+	if !hasRemaining || !ok {
+		return
+	}
+
+	h := l.host(name)
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	account := accountFrom(ctx)
+	b := h.budget(account)
+	if remaining == 0 && (b.remaining != 0 || !b.reset.Equal(reset)) {
+		if account != "" {
+			log.Warnf("Rate limit for %s exhausted for %s (limit %s); waiting until %s", name, account, resp.Header.Get("RateLimit-Limit"), reset.Format(time.RFC3339))
+		} else {
+			log.Warnf("Rate limit for %s exhausted (limit %s); waiting until %s", name, resp.Header.Get("RateLimit-Limit"), reset.Format(time.RFC3339))
+		}
+	}
+	b.remaining = remaining
+	b.reset = reset
+}
+
+// ResetTime is when a response says its rate limit window resets, per
+// Retry-After (for 429s) or RateLimit-Reset.
+func ResetTime(resp *http.Response) (time.Time, bool) {
+	now := time.Now()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if retryAfter, ok := parseInt(resp.Header.Get("Retry-After")); ok {
+			return now.Add(time.Duration(retryAfter) * time.Second), true
+		}
+	}
+	return parseReset(resp.Header.Get("RateLimit-Reset"), now)
+}
+
+func parseInt(value string) (int64, bool) {
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return n, err == nil
+}
+
+// RateLimit-Reset is a Unix timestamp from Bluesky's services, but the IETF
+// draft has it as seconds from now; anything too small to be a recent
+// timestamp is taken to be the latter. Either way it's rounded to the second,
+// so we allow an extra second for the window to actually reset.
+func parseReset(value string, now time.Time) (time.Time, bool) {
+	n, ok := parseInt(value)
+	if !ok {
+		return time.Time{}, false
+	}
+	if n > 1_000_000_000 {
+		return time.Unix(n+1, 0), true
+	}
+	return now.Add(time.Duration(n+1) * time.Second), true
+}
+
+// Transport wraps an HTTP transport (nil for the default one) so that every
+// request through it waits for its host's budget, and every response updates
+// it.
+func (l *Limits) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{limits: l, next: next}
+}
+
+type transport struct {
+	limits *Limits
+	next   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limits.Wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if resp != nil {
+		t.limits.Observe(req.Context(), req.URL.Host, resp)
+	}
+	return resp, err
+}
+
+// ParseHostRates parses per-host rates in host=rate form (e.g.,
+// public.api.bsky.app=50).
+func ParseHostRates(values []string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, value := range values {
+		name, rate, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid host rate limit %q: expected host=rate", value)
+		}
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid rate in host rate limit %q", value)
+		}
+		rates[name] = parsed
+	}
+	return rates, nil
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/DmitriyVTitov/size"
 	"github.com/ipfs/go-cid"
 	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/auth"
+	"github.com/stanfordio/skyfall/pkg/metrics"
 	"github.com/stanfordio/skyfall/pkg/utils"
 	"go.uber.org/ratelimit"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	atpidentity "github.com/bluesky-social/indigo/atproto/identity"
@@ -25,18 +30,33 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// Requests per second to the AppView when running unauthenticated, to stay well
+// within what it allows anonymous clients (3,000 requests per five minutes)
+const UnauthenticatedRate = 8
+
 type Hydrator struct {
 	Cache             *ristretto.Cache
-	AuthInfo          *xrpc.AuthInfo
+	Sessions          *auth.Pool // Sessions to authenticate AppView requests with, in turn; nil or empty to not authenticate
 	Context           context.Context
 	Client            *xrpc.Client
 	IdentityDirectory identity.Directory
-	Ratelimit         ratelimit.Limiter // Rate limiting for authenticated endpoints. May be called by other packages whenever they make a rate-limited request.
+	Ratelimit         ratelimit.Limiter         // Optional overall cap on lookups, on top of the per-host limits that every client gets from pkg/hostlimit. May be called by other packages whenever they make a rate-limited request.
+	PersistentCache   *PersistentCache          // Optional on-disk cache behind the in-memory cache; nil if disabled
+	Level             HydrationLevel            // How much to hydrate records by default
+	CollectionLevels  map[string]HydrationLevel // Per-collection overrides of Level, keyed by NSID (e.g., app.bsky.feed.like)
+	PLCHost           string                    // PLC directory to fetch audit logs from
+	PLCClient         *http.Client
+	RepoClient        *http.Client // For getRepo, which can take a while for big repos
+	IdentityHistory   bool         // Whether to add each actor's identity history (from the PLC audit log) to their projection
+	Local             LocalLookup  // Consulted for identities and profiles before the network; nil if disabled
+	Offline           bool         // Never make network calls; lookups that miss the caches and Local fail with ErrOffline
 }
 
-var didRegex = regexp.MustCompile(`did:plc:[a-zA-Z0-9]+`)
+// Matches did:plc and did:web DIDs. In atproto, did:web DIDs are bare hostnames
+// (no paths), possibly with a percent-encoded port.
+var didRegex = regexp.MustCompile(`did:(?:plc:[a-zA-Z0-9]+|web:[a-zA-Z0-9._%-]+)`)
 
-func MakeHydrator(ctx context.Context, cacheSize int64, authInfo *xrpc.AuthInfo) (*Hydrator, error) {
+func MakeHydrator(ctx context.Context, cacheSize int64, sessions *auth.Pool) (*Hydrator, error) {
 	cache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e8, // number of keys to track frequency of
 		MaxCost:     cacheSize,
@@ -51,43 +71,129 @@ func MakeHydrator(ctx context.Context, cacheSize int64, authInfo *xrpc.AuthInfo)
 		return nil, fmt.Errorf("failed to create cache: %+v", err)
 	}
 
+	client := utils.RetryingHTTPClient()
+	if sessions != nil {
+		client = utils.RetryingHTTPClientWith(sessions.Transport)
+	}
+
 	h := Hydrator{
 		Cache:   cache,
 		Context: ctx,
 		Client: &xrpc.Client{
-			Client: utils.RetryingHTTPClient(),
+			Client: client,
 			Host:   "https://public.api.bsky.app", // We generally want to use the public.api.bsky.app host for all requests, since they are doing the indexing (and it's public with big rate limits)
-			Auth:   authInfo,
 		},
 		IdentityDirectory: atpidentity.DefaultDirectory(),
-		AuthInfo:          authInfo,
-		Ratelimit:         ratelimit.New(1000), // 1000 requests per second; empirically we find that this is fine
+		Sessions:          sessions,
+		Ratelimit:         ratelimit.NewUnlimited(), // Requests are paced per host instead
+		Level:             HydrationFull,
+		CollectionLevels:  make(map[string]HydrationLevel),
+		PLCHost:           "https://plc.directory",
+		PLCClient:         utils.RetryingHTTPClient(),
+		RepoClient:        utils.RateLimitedHTTPClient(),
 	}
 
 	return &h, nil
 }
 
+// Close closes the persistent cache, if there is one.
+func (h *Hydrator) Close() error {
+	if h.PersistentCache == nil {
+		return nil
+	}
+	return h.PersistentCache.Close()
+}
+
 func namespaceKey(namespace string, key string) string {
 	return fmt.Sprintf("%s:%s", namespace, key)
 }
 
+// Looks up a key in the in-memory cache, falling back to the persistent cache
+// (if there is one). Hits from disk are promoted back into memory. If what we
+// cached was an error, it's returned as cachedErr.
+func cacheGet[T any](h *Hydrator, key string) (value T, cachedErr error, found bool) {
+	namespace, _, _ := strings.Cut(key, ":")
+	defer func() { metrics.CacheLookup(namespace, found) }()
+
+	cachedValue, found := h.Cache.Get(key)
+	if found && cachedValue != nil {
+		if cachedError, isErr := cachedValue.(error); isErr {
+			return value, cachedError, true
+		}
+		return cachedValue.(T), nil, true
+	}
+
+	if h.PersistentCache == nil {
+		return value, nil, false
+	}
+
+	found, cachedErr, err := h.PersistentCache.Get(key, &value)
+	if err != nil {
+		log.Warnf("Failed to read %s from persistent cache: %s", key, err)
+		return value, nil, false
+	}
+	if !found {
+		return value, nil, false
+	}
+
+	if cachedErr != nil {
+		h.Cache.SetWithTTL(key, cachedErr, 0, time.Duration(1)*time.Hour*24)
+	} else {
+		h.Cache.SetWithTTL(key, value, 0, time.Duration(1)*time.Hour*24)
+	}
+
+	return value, cachedErr, true
+}
+
+// Stores a value (or an error) in the in-memory cache and, if there is one, the
+// persistent cache.
+func (h *Hydrator) cacheSet(key string, value interface{}) {
+	h.Cache.SetWithTTL(key, value, 0, time.Duration(1)*time.Hour*24)
+
+	if h.PersistentCache != nil {
+		if err := h.PersistentCache.Set(key, value); err != nil {
+			log.Warnf("Failed to write %s to persistent cache: %s", key, err)
+		}
+	}
+}
+
+// Drops a key from both the in-memory and the persistent cache.
+func (h *Hydrator) cacheDelete(key string) {
+	h.Cache.Del(key)
+
+	if h.PersistentCache != nil {
+		if err := h.PersistentCache.Delete(key); err != nil {
+			log.Warnf("Failed to delete %s from persistent cache: %s", key, err)
+		}
+	}
+}
+
 func (h *Hydrator) LookupIdentity(identifier string) (identity *atpidentity.Identity, err error) {
 	key := namespaceKey("identity", identifier)
 
 	// Check the cache first
-	cachedValue, found := h.Cache.Get(key)
+	cachedValue, cachedError, found := cacheGet[*atpidentity.Identity](h, key)
 
-	if found && cachedValue != nil {
-		if cachedError, isErr := cachedValue.(error); isErr {
+	if found {
+		if cachedError != nil {
 			log.Debugf("Cached error for %s: %v", identifier, cachedError)
 			return nil, cachedError // Return the cached error
 		}
-		identity = cachedValue.(*atpidentity.Identity)
+		identity = cachedValue
 		return
 	}
 
 	log.Debugf("Cache miss for %s", identifier)
 
+	if h.Local != nil {
+		if identity, found := h.Local.LookupIdentity(identifier); found {
+			return identity, nil
+		}
+	}
+	if h.Offline {
+		return nil, fmt.Errorf("identity %s: %w", identifier, ErrOffline)
+	}
+
 	h.Ratelimit.Take()
 	resolvedIdentifier, error := syntax.ParseAtIdentifier(identifier)
 	if error != nil {
@@ -97,15 +203,32 @@ func (h *Hydrator) LookupIdentity(identifier string) (identity *atpidentity.Iden
 
 	identity, err = h.IdentityDirectory.Lookup(h.Context, *resolvedIdentifier)
 	if err != nil {
-		h.Cache.SetWithTTL(key, err, 0, time.Duration(1)*time.Hour*24)
+		h.cacheSet(key, err)
 		return
 	}
 
-	h.Cache.SetWithTTL(key, identity, 0, time.Duration(1)*time.Hour*24)
+	h.cacheSet(key, identity)
 
 	return
 }
 
+// RefreshIdentity re-resolves an identity, bypassing (and then replacing) any
+// cached copy. This is useful when a cached identity may be stale, e.g. after
+// the account rotated its signing key.
+func (h *Hydrator) RefreshIdentity(identifier string) (identity *atpidentity.Identity, err error) {
+	h.cacheDelete(namespaceKey("identity", identifier))
+
+	resolvedIdentifier, err := syntax.ParseAtIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.IdentityDirectory.Purge(h.Context, *resolvedIdentifier); err != nil {
+		log.Warnf("Failed to purge %s from the identity directory: %s", identifier, err)
+	}
+
+	return h.LookupIdentity(identifier)
+}
+
 func (h *Hydrator) lookupProfileFromIdentity(identity *atpidentity.Identity) (profile *bsky.ActorDefs_ProfileViewDetailed, err error) {
 	if identity == nil {
 		return nil, fmt.Errorf("identity is nil")
@@ -114,27 +237,36 @@ func (h *Hydrator) lookupProfileFromIdentity(identity *atpidentity.Identity) (pr
 	key := namespaceKey("profile", identity.Handle.String())
 
 	// Check the cache first
-	cachedValue, found := h.Cache.Get(key)
+	cachedValue, cachedError, found := cacheGet[*bsky.ActorDefs_ProfileViewDetailed](h, key)
 
-	if found && cachedValue != nil {
-		if cachedError, isErr := cachedValue.(error); isErr {
+	if found {
+		if cachedError != nil {
 			log.Warnf("Found cached error for %s: %v", identity.Handle.String(), cachedError)
 			return nil, cachedError
 		}
-		profile = cachedValue.(*bsky.ActorDefs_ProfileViewDetailed)
+		profile = cachedValue
 		return
 	}
 
+	if h.Local != nil {
+		if profile, found := h.Local.LookupProfile(identity.DID.String()); found {
+			return profile, nil
+		}
+	}
+	if h.Offline {
+		return nil, fmt.Errorf("profile %s: %w", identity.DID, ErrOffline)
+	}
+
 	h.Ratelimit.Take()
 	profile, err = bsky.ActorGetProfile(h.Context, h.Client, identity.Handle.String())
 
 	if err != nil { // Cache if error looking up profile like suspended
 		log.Warnf("Profile lookup failed for identity %s: %s", identity.Handle.String(), err)
-		h.Cache.SetWithTTL(key, err, 0, time.Duration(1)*time.Hour*24)
+		h.cacheSet(key, err)
 		return nil, err
 	}
 
-	h.Cache.SetWithTTL(key, profile, 0, time.Duration(1)*time.Hour*24)
+	h.cacheSet(key, profile)
 
 	return profile, nil
 }
@@ -152,19 +284,23 @@ func (h *Hydrator) lookupPost(atUrl string) (post *bsky.FeedDefs_PostView, err e
 	key := namespaceKey("post", atUrl)
 
 	// Check the cache first
-	cachedValue, found := h.Cache.Get(key)
+	cachedValue, cachedError, found := cacheGet[*bsky.FeedDefs_PostView](h, key)
 
-	if found && cachedValue != nil {
-		if cachedError, isErr := cachedValue.(error); isErr {
+	if found {
+		if cachedError != nil {
 			log.Warnf("Cached error for %s: %v", atUrl, cachedError)
 			return nil, cachedError
 		}
-		post = cachedValue.(*bsky.FeedDefs_PostView)
+		post = cachedValue
 		return
 	}
 
 	log.Debugf("Cache miss for %s", atUrl)
 
+	if h.Offline {
+		return nil, fmt.Errorf("post %s: %w", atUrl, ErrOffline)
+	}
+
 	h.Ratelimit.Take()
 	output, err := bsky.FeedGetPosts(h.Context, h.Client, []string{atUrl})
 
@@ -178,13 +314,54 @@ func (h *Hydrator) lookupPost(atUrl string) (post *bsky.FeedDefs_PostView, err e
 	}
 
 	if err != nil { // caching miss so we don't keep checking
-		h.Cache.SetWithTTL(key, err, 0, time.Duration(1)*time.Hour*24)
+		h.cacheSet(key, err)
 		return
 	}
 
 	post = output.Posts[0]
 
-	h.Cache.SetWithTTL(key, post, 0, time.Duration(1)*time.Hour*24)
+	h.cacheSet(key, post)
+
+	return
+}
+
+func (h *Hydrator) lookupList(atUrl string) (list *bsky.GraphDefs_ListView, err error) {
+	key := namespaceKey("list", atUrl)
+
+	// Check the cache first
+	cachedValue, cachedError, found := cacheGet[*bsky.GraphDefs_ListView](h, key)
+
+	if found {
+		if cachedError != nil {
+			log.Warnf("Cached error for %s: %v", atUrl, cachedError)
+			return nil, cachedError
+		}
+		list = cachedValue
+		return
+	}
+
+	log.Debugf("Cache miss for %s", atUrl)
+
+	if h.Offline {
+		return nil, fmt.Errorf("list %s: %w", atUrl, ErrOffline)
+	}
+
+	h.Ratelimit.Take()
+	output, err := bsky.GraphGetList(h.Context, h.Client, "", 1, atUrl)
+
+	if err == nil && output.List == nil {
+		err = fmt.Errorf("no list found for %s", atUrl)
+	}
+
+	if err != nil { // caching miss so we don't keep checking
+		log.Warnf("Unable to fetch list at %s: %s", atUrl, err)
+		h.cacheSet(key, err)
+		return
+	}
+
+	list = output.List
+
+	h.cacheSet(key, list)
 
 	return
 }
@@ -196,15 +373,14 @@ func (h *Hydrator) flattenIdentity(identity *atpidentity.Identity) (result map[s
 
 	result = make(map[string]interface{})
 
-	result["DID"] = identity.Handle.String()
+	result["DID"] = identity.DID.String()
 	result["Handle"] = identity.Handle
 
 	var pk crypto.PublicKey
-	pk, _ = identity.PublicKey()
-	if err != nil {
-		log.Warnf("Failed to get public key for actor: %s, %s", identity.Handle, err)
+	pk, pkErr := identity.PublicKey()
+	if pkErr != nil {
+		log.Warnf("Failed to get public key for actor: %s, %s", identity.Handle, pkErr)
 	} else {
-
 		result["DIDKey"] = pk.DIDKey()
 	}
 
@@ -213,6 +389,48 @@ func (h *Hydrator) flattenIdentity(identity *atpidentity.Identity) (result map[s
 	return
 }
 
+// Flattens the labels that an author applied to their own record.
+func (h *Hydrator) flattenSelfLabels(labels *atproto.LabelDefs_SelfLabels) (values []string) {
+	values = []string{}
+	if labels == nil {
+		return
+	}
+
+	for _, label := range labels.Values {
+		if label != nil {
+			values = append(values, label.Val)
+		}
+	}
+
+	return
+}
+
+// Flattens labels as returned by the AppView, which includes those applied by
+// moderation services (and self-labels, with the author as the source).
+func (h *Hydrator) flattenLabels(labels []*atproto.LabelDefs_Label) (result []map[string]interface{}) {
+	result = make([]map[string]interface{}, 0)
+
+	for _, label := range labels {
+		if label == nil {
+			continue
+		}
+
+		labelResult := make(map[string]interface{})
+		labelResult["Src"] = label.Src
+		labelResult["URI"] = label.Uri
+		labelResult["CID"] = label.Cid
+		labelResult["Val"] = label.Val
+		labelResult["Neg"] = label.Neg != nil && *label.Neg
+		labelResult["CreatedAt"] = label.Cts
+		if label.Exp != nil {
+			labelResult["ExpiresAt"] = *label.Exp
+		}
+		result = append(result, labelResult)
+	}
+
+	return
+}
+
 func (h *Hydrator) flattenProfile(profile *bsky.ActorDefs_ProfileViewBasic) (result map[string]interface{}) {
 	if profile == nil {
 		return nil
@@ -238,6 +456,12 @@ func (h *Hydrator) flattenActorProfile(profile *bsky.ActorProfile) (result map[s
 	result["DisplayName"] = profile.DisplayName
 	result["Description"] = profile.Description
 
+	if profile.Labels != nil {
+		result["SelfLabels"] = h.flattenSelfLabels(profile.Labels.LabelDefs_SelfLabels)
+	} else {
+		result["SelfLabels"] = []string{}
+	}
+
 	return
 }
 
@@ -257,25 +481,55 @@ func (h *Hydrator) flattenFullProfile(profile *bsky.ActorDefs_ProfileViewDetaile
 	result["FollowsCount"] = profile.FollowsCount
 	result["PostsCount"] = profile.PostsCount
 	result["IndexedAt"] = profile.IndexedAt
+	result["Labels"] = h.flattenLabels(profile.Labels)
 
 	return
 }
 
-func (h *Hydrator) flattenFacets(facets []*bsky.RichtextFacet) (hashtags []string, urls []string) {
+// Flattens rich text facets. Alongside the hashtags, URLs and mentioned DIDs,
+// we keep every facet's byte range so that the spans can be reconstructed from
+// the text.
+func (h *Hydrator) flattenFacets(facets []*bsky.RichtextFacet) (hashtags []string, urls []string, mentions []map[string]interface{}, spans []map[string]interface{}) {
 	hashtags = []string{}
 	urls = []string{}
+	mentions = []map[string]interface{}{}
+	spans = []map[string]interface{}{}
 	if facets != nil {
 		for _, facet := range facets {
 			if facet != nil {
 				features := facet.Features
 				for _, feature := range features {
+					if feature == nil {
+						continue
+					}
+
+					span := make(map[string]interface{})
+					if facet.Index != nil {
+						span["ByteStart"] = facet.Index.ByteStart
+						span["ByteEnd"] = facet.Index.ByteEnd
+					}
+
 					if feature.RichtextFacet_Tag != nil {
 						tag := feature.RichtextFacet_Tag.Tag
 						hashtags = append(hashtags, tag)
+						span["Type"] = "tag"
+						span["Value"] = tag
 					}
 					if feature.RichtextFacet_Link != nil {
 						url := feature.RichtextFacet_Link.Uri
 						urls = append(urls, url)
+						span["Type"] = "link"
+						span["Value"] = url
+					}
+					if feature.RichtextFacet_Mention != nil {
+						did := feature.RichtextFacet_Mention.Did
+						mentions = append(mentions, map[string]interface{}{"DID": did})
+						span["Type"] = "mention"
+						span["Value"] = did
+					}
+
+					if span["Type"] != nil {
+						spans = append(spans, span)
 					}
 				}
 			}
@@ -284,6 +538,28 @@ func (h *Hydrator) flattenFacets(facets []*bsky.RichtextFacet) (hashtags []strin
 	return
 }
 
+// Fills in the handles of the accounts mentioned in a flattened post.
+func (h *Hydrator) hydrateMentions(flatPost map[string]interface{}) {
+	if flatPost == nil {
+		return
+	}
+
+	mentions, ok := flatPost["Mentions"].([]map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for _, mention := range mentions {
+		did, _ := mention["DID"].(string)
+		identity, err := h.LookupIdentity(did)
+		if err != nil {
+			log.Warnf("Failed to lookup identity for mentioned user %s: %s", did, err)
+			continue
+		}
+		mention["Handle"] = identity.Handle.String()
+	}
+}
+
 func (h *Hydrator) flattenPostView(post *bsky.FeedDefs_PostView) (result map[string]interface{}) {
 	if post == nil {
 		return nil
@@ -302,6 +578,7 @@ func (h *Hydrator) flattenPostView(post *bsky.FeedDefs_PostView) (result map[str
 	result["ReplyCount"] = post.ReplyCount
 	result["LikeCount"] = post.LikeCount
 	result["URI"] = post.Uri
+	result["Labels"] = h.flattenLabels(post.Labels)
 
 	rec := post.Record.Val.(*bsky.FeedPost)
 	result["Text"] = rec.Text
@@ -316,9 +593,17 @@ func (h *Hydrator) flattenPostView(post *bsky.FeedDefs_PostView) (result map[str
 		result["Embed"] = h.flattenEmbed(rec.Embed)
 	}
 
-	hashtags, urls := h.flattenFacets(rec.Facets)
+	hashtags, urls, mentions, facets := h.flattenFacets(rec.Facets)
 	result["Hashtags"] = hashtags
 	result["URLs"] = urls
+	result["Mentions"] = mentions
+	result["Facets"] = facets
+
+	if rec.Labels != nil {
+		result["SelfLabels"] = h.flattenSelfLabels(rec.Labels.LabelDefs_SelfLabels)
+	} else {
+		result["SelfLabels"] = []string{}
+	}
 
 	return
 }
@@ -342,6 +627,11 @@ func (h *Hydrator) flattenPost(post *bsky.FeedPost) (result map[string]interface
 		// For some reason replies can lack a parent
 		if post.Reply.Parent != nil {
 			result["ReplyParentCID"] = post.Reply.Parent.Cid
+			result["ReplyParentURI"] = post.Reply.Parent.Uri
+		}
+		if post.Reply.Root != nil {
+			result["ReplyRootCID"] = post.Reply.Root.Cid
+			result["ReplyRootURI"] = post.Reply.Root.Uri
 		}
 	}
 
@@ -349,9 +639,241 @@ func (h *Hydrator) flattenPost(post *bsky.FeedPost) (result map[string]interface
 		result["Embed"] = h.flattenEmbed(post.Embed)
 	}
 
-	hashtags, urls := h.flattenFacets(post.Facets)
+	hashtags, urls, mentions, facets := h.flattenFacets(post.Facets)
 	result["Hashtags"] = hashtags
 	result["URLs"] = urls
+	result["Mentions"] = mentions
+	result["Facets"] = facets
+
+	if post.Labels != nil {
+		result["SelfLabels"] = h.flattenSelfLabels(post.Labels.LabelDefs_SelfLabels)
+	} else {
+		result["SelfLabels"] = []string{}
+	}
+
+	return
+}
+
+func (h *Hydrator) flattenListView(list *bsky.GraphDefs_ListView) (result map[string]interface{}) {
+	if list == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["URI"] = list.Uri
+	result["Name"] = list.Name
+	result["Purpose"] = list.Purpose
+	result["Description"] = list.Description
+	result["ListItemCount"] = list.ListItemCount
+	result["IndexedAt"] = list.IndexedAt
+	if list.Creator != nil {
+		result["CreatorDID"] = list.Creator.Did
+		result["CreatorHandle"] = list.Creator.Handle
+	}
+
+	return
+}
+
+func (h *Hydrator) flattenList(list *bsky.GraphList) (result map[string]interface{}) {
+	if list == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["Name"] = list.Name
+	result["Purpose"] = list.Purpose
+	result["Description"] = list.Description
+
+	return
+}
+
+func (h *Hydrator) flattenListItem(item *bsky.GraphListitem) (result map[string]interface{}) {
+	if item == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["ListURI"] = item.List
+	result["SubjectDID"] = item.Subject
+
+	return
+}
+
+func (h *Hydrator) flattenListBlock(block *bsky.GraphListblock) (result map[string]interface{}) {
+	if block == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["ListURI"] = block.Subject
+
+	return
+}
+
+func (h *Hydrator) flattenStarterpack(pack *bsky.GraphStarterpack) (result map[string]interface{}) {
+	if pack == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["Name"] = pack.Name
+	result["Description"] = pack.Description
+	result["ListURI"] = pack.List
+
+	feeds := []string{}
+	for _, feed := range pack.Feeds {
+		if feed != nil {
+			feeds = append(feeds, feed.Uri)
+		}
+	}
+	result["FeedURIs"] = feeds
+
+	return
+}
+
+func (h *Hydrator) flattenThreadgate(gate *bsky.FeedThreadgate) (result map[string]interface{}) {
+	if gate == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["PostURI"] = gate.Post
+
+	// No allow rules at all means nobody can reply
+	allowMentioned := false
+	allowFollowing := false
+	allowLists := []string{}
+	for _, rule := range gate.Allow {
+		if rule == nil {
+			continue
+		}
+		if rule.FeedThreadgate_MentionRule != nil {
+			allowMentioned = true
+		}
+		if rule.FeedThreadgate_FollowingRule != nil {
+			allowFollowing = true
+		}
+		if rule.FeedThreadgate_ListRule != nil {
+			allowLists = append(allowLists, rule.FeedThreadgate_ListRule.List)
+		}
+	}
+	result["AllowMentioned"] = allowMentioned
+	result["AllowFollowing"] = allowFollowing
+	result["AllowListURIs"] = allowLists
+
+	result["HiddenReplies"] = gate.HiddenReplies
+	if gate.HiddenReplies == nil {
+		result["HiddenReplies"] = []string{}
+	}
+
+	return
+}
+
+func (h *Hydrator) flattenPostgate(gate *bsky.FeedPostgate) (result map[string]interface{}) {
+	if gate == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["PostURI"] = gate.Post
+
+	disableEmbedding := false
+	for _, rule := range gate.EmbeddingRules {
+		if rule != nil && rule.FeedPostgate_DisableRule != nil {
+			disableEmbedding = true
+		}
+	}
+	result["DisableEmbedding"] = disableEmbedding
+
+	result["DetachedEmbeddingURIs"] = gate.DetachedEmbeddingUris
+	if gate.DetachedEmbeddingUris == nil {
+		result["DetachedEmbeddingURIs"] = []string{}
+	}
+
+	return
+}
+
+func (h *Hydrator) flattenFeedGenerator(generator *bsky.FeedGenerator) (result map[string]interface{}) {
+	if generator == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["DID"] = generator.Did
+	result["DisplayName"] = generator.DisplayName
+	result["Description"] = generator.Description
+	result["AcceptsInteractions"] = generator.AcceptsInteractions
+
+	return
+}
+
+func (h *Hydrator) flattenLabelerService(service *bsky.LabelerService) (result map[string]interface{}) {
+	if service == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	labelValues := []string{}
+	if service.Policies != nil {
+		for _, value := range service.Policies.LabelValues {
+			if value != nil {
+				labelValues = append(labelValues, *value)
+			}
+		}
+	}
+	result["LabelValues"] = labelValues
+
+	return
+}
+
+func (h *Hydrator) flattenChatDeclaration(declaration *chat.ActorDeclaration) (result map[string]interface{}) {
+	if declaration == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["AllowIncoming"] = declaration.AllowIncoming
+
+	return
+}
+
+// How much of a referenced (parent, root or quoted) post's text we keep
+const referencedPostSnippetLength = 100
+
+// Flattens a post that another post replies to or quotes. This is deliberately
+// smaller than flattenPostView, since it's just there for context.
+func (h *Hydrator) flattenReferencedPost(post *bsky.FeedDefs_PostView) (result map[string]interface{}) {
+	if post == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["URI"] = post.Uri
+	result["CID"] = post.Cid
+	if post.Author != nil {
+		result["AuthorDID"] = post.Author.Did
+		result["AuthorHandle"] = post.Author.Handle
+	}
+
+	if rec, ok := post.Record.Val.(*bsky.FeedPost); ok {
+		text := []rune(rec.Text)
+		if len(text) > referencedPostSnippetLength {
+			text = text[:referencedPostSnippetLength]
+		}
+		result["Text"] = string(text)
+		result["CreatedAt"] = rec.CreatedAt
+	}
 
 	return
 }
@@ -364,8 +886,20 @@ func (h *Hydrator) extractAllDids(str string) []string {
 	// Find all matches of the regular expression in the string
 	matches := didRegex.FindAllString(str, -1)
 
+	// did:web matches can pick up trailing punctuation (e.g., the period at the
+	// end of a sentence), so clean them up and drop anything that isn't valid
+	dids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		match = strings.TrimRight(match, ".-")
+		if _, err := syntax.ParseDID(match); err != nil {
+			log.Debugf("Skipping invalid DID %s: %s", match, err)
+			continue
+		}
+		dids = append(dids, match)
+	}
+
 	// Return the slice of extracted DIDs
-	return matches
+	return dids
 }
 
 func (h *Hydrator) GetIdentitiesInRepo(repo *repo.Repo) ([]atpidentity.Identity, error) {
@@ -407,6 +941,23 @@ func (h *Hydrator) GetIdentitiesInRepo(repo *repo.Repo) ([]atpidentity.Identity,
 	return identities, err
 }
 
+// ResolvePDSEndpoint finds the PDS that hosts an actor's repo from their DID
+// document. This works for both did:plc and did:web actors, including those on
+// self-hosted PDSes.
+func (h *Hydrator) ResolvePDSEndpoint(actorDid string) (string, error) {
+	identity, err := h.LookupIdentity(actorDid)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := identity.PDSEndpoint()
+	if endpoint == "" {
+		return "", fmt.Errorf("no PDS endpoint found for %s", actorDid)
+	}
+
+	return endpoint, nil
+}
+
 func (h *Hydrator) GetRepoBytes(actorDid string, pdsEndpoint string) ([]byte, error) {
 	key := namespaceKey("repo", actorDid)
 
@@ -419,7 +970,8 @@ func (h *Hydrator) GetRepoBytes(actorDid string, pdsEndpoint string) ([]byte, er
 	}
 
 	xrpcc := xrpc.Client{
-		Host: pdsEndpoint,
+		Client: h.RepoClient,
+		Host:   pdsEndpoint,
 	}
 
 	h.Ratelimit.Take()
@@ -439,6 +991,60 @@ func (h *Hydrator) invalidateRepoCache(actorDid string) {
 	h.Cache.Del(actorDid)
 }
 
+func (h *Hydrator) flattenExternal(external *bsky.EmbedExternal_External) (result map[string]interface{}) {
+	if external == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["URI"] = external.Uri
+	result["Title"] = external.Title
+	result["Description"] = external.Description
+	if external.Thumb != nil {
+		result["ThumbBlobLink"] = external.Thumb.Ref.String()
+		result["ThumbMimeType"] = external.Thumb.MimeType
+	}
+
+	return
+}
+
+func (h *Hydrator) flattenVideo(video *bsky.EmbedVideo) (result map[string]interface{}) {
+	if video == nil {
+		return nil
+	}
+
+	result = make(map[string]interface{})
+
+	result["Alt"] = video.Alt
+	if video.Video != nil {
+		result["BlobLink"] = video.Video.Ref.String()
+		result["MimeType"] = video.Video.MimeType
+		result["Size"] = video.Video.Size
+	}
+	if video.AspectRatio != nil {
+		result["Width"] = video.AspectRatio.Width
+		result["Height"] = video.AspectRatio.Height
+	}
+
+	captions := make([]map[string]interface{}, 0)
+	for _, caption := range video.Captions {
+		if caption == nil {
+			continue
+		}
+		captionResult := make(map[string]interface{})
+		captionResult["Lang"] = caption.Lang
+		if caption.File != nil {
+			captionResult["BlobLink"] = caption.File.Ref.String()
+			captionResult["MimeType"] = caption.File.MimeType
+		}
+		captions = append(captions, captionResult)
+	}
+	result["Captions"] = captions
+
+	return
+}
+
 func (h *Hydrator) flattenEmbed(embed *bsky.FeedPost_Embed) (result map[string]interface{}) {
 	if embed == nil {
 		return nil
@@ -446,17 +1052,15 @@ func (h *Hydrator) flattenEmbed(embed *bsky.FeedPost_Embed) (result map[string]i
 
 	result = make(map[string]interface{})
 
-	// Three types of embeds: external links, images, records, and records with media
-	if embed.EmbedExternal != nil && embed.EmbedExternal.External != nil {
-		externalEmbedResult := make(map[string]interface{})
-		externalEmbedResult["URI"] = embed.EmbedExternal.External.Uri
-		externalEmbedResult["Title"] = embed.EmbedExternal.External.Title
-		externalEmbedResult["Description"] = embed.EmbedExternal.External.Description
-		result["External"] = externalEmbedResult
+	// Five types of embeds: external links, images, videos, records, and records with media
+	if embed.EmbedExternal != nil {
+		result["External"] = h.flattenExternal(embed.EmbedExternal.External)
 	} else {
 		result["External"] = nil
 	}
 
+	result["Video"] = h.flattenVideo(embed.EmbedVideo)
+
 	if embed.EmbedImages != nil && len(embed.EmbedImages.Images) > 0 {
 		images := make([]map[string]interface{}, 0)
 		for _, image := range embed.EmbedImages.Images {
@@ -513,6 +1117,10 @@ func (h *Hydrator) flattenEmbed(embed *bsky.FeedPost_Embed) (result map[string]i
 					media = append(media, mediaResult)
 				}
 			}
+			result["EmbedRecordVideo"] = h.flattenVideo(embed.EmbedRecordWithMedia.Media.EmbedVideo)
+			if embed.EmbedRecordWithMedia.Media.EmbedExternal != nil {
+				result["EmbedRecordExternal"] = h.flattenExternal(embed.EmbedRecordWithMedia.Media.EmbedExternal.External)
+			}
 		}
 		result["EmbedRecordMedia"] = media
 
@@ -522,7 +1130,7 @@ func (h *Hydrator) flattenEmbed(embed *bsky.FeedPost_Embed) (result map[string]i
 	return
 }
 
-func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]interface{}, err error) {
+func (h *Hydrator) Hydrate(val interface{}, actorDid string, path string) (result map[string]interface{}, err error) {
 	err = nil
 
 	result = make(map[string]interface{})
@@ -534,6 +1142,27 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 		return
 	}
 
+	collection, _ := full["LexiconTypeID"].(string)
+	level := h.levelFor(collection)
+
+	// Add key metadata to the outer map
+	result["Type"] = full["LexiconTypeID"]
+	result["CreatedAt"] = full["CreatedAt"]
+	result["PulledTimestamp"] = time.Now().Format(time.RFC3339)
+	result["URI"] = fmt.Sprintf("at://%s/%s", actorDid, path)
+
+	full["_ActorDid"] = actorDid
+
+	if level == HydrationNone {
+		// Raw mode: no network calls at all, just what's in the record
+		projection["Actor"] = map[string]interface{}{"DID": actorDid}
+		h.projectRecord(val, projection)
+
+		result["Full"] = full
+		result["Projection"] = projection
+		return
+	}
+
 	// Resolve full identity and profile information for the actor
 	identity, err := h.LookupIdentity(actorDid)
 	if err != nil {
@@ -541,19 +1170,16 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 		identity = nil
 	}
 
-	profile, err := h.lookupProfileFromIdentity(identity)
-	if err != nil {
-		log.Warnf("Failed to lookup profile for actor %s: %s", actorDid, err)
-		profile = nil
+	var profile *bsky.ActorDefs_ProfileViewDetailed
+	if level >= HydrationFull {
+		profile, err = h.lookupProfileFromIdentity(identity)
+		if err != nil {
+			log.Warnf("Failed to lookup profile for actor %s: %s", actorDid, err)
+			profile = nil
+		}
 	}
 
-	// Add key metadata to the outer map
-	result["Type"] = full["LexiconTypeID"]
-	result["CreatedAt"] = full["CreatedAt"]
-	result["PulledTimestamp"] = time.Now().Format(time.RFC3339)
-
-	// Add the actorDid and profile to the map
-	full["_ActorDid"] = actorDid
+	// Add the actor's identity and profile to the map
 	full["_ActorIdentity"] = identity
 	full["_ActorProfile"] = profile
 	flat, err := h.flattenIdentity(identity)
@@ -563,9 +1189,120 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 	}
 	projection["Actor"] = flat
 
+	if h.IdentityHistory && flat != nil && strings.HasPrefix(actorDid, "did:plc:") {
+		history, err := h.LookupIdentityHistory(actorDid)
+		if err != nil {
+			log.Warnf("Failed to lookup identity history for actor %s: %s", actorDid, err)
+		} else {
+			flat["IdentityHistory"] = history
+		}
+	}
+
+	h.projectRecord(val, projection)
+	if level >= HydrationFull {
+		h.hydrateSubjects(val, full, projection)
+	}
+	if level >= HydrationDeep {
+		h.hydrateReferencedPosts(val, full, projection)
+	}
+
+	// Add the full object to the result
+	result["Full"] = full
+	result["Projection"] = projection
+
+	return
+}
+
+// SetCID records the CID of the record a hydrated row is for, alongside the
+// other extras in Full. Rows pulled from repos don't have a seq, so this is
+// what tells versions of a record apart (e.g., when deduplicating output).
+func (h *Hydrator) SetCID(row map[string]interface{}, c cid.Cid) {
+	if full, ok := row["Full"].(map[string]interface{}); ok {
+		full["_CID"] = c.String()
+	}
+}
+
+// HydrateLabel turns a label from a labeler's label stream into the same shape
+// as a hydrated record. The "actor" of a label is the labeler that issued it.
+func (h *Hydrator) HydrateLabel(label *atproto.LabelDefs_Label) (result map[string]interface{}, err error) {
+	result = make(map[string]interface{})
+	full := make(map[string]interface{})
+	projection := make(map[string]interface{})
+	err = mapstructure.Decode(label, &full)
+
+	if err != nil {
+		return
+	}
+
+	result["Type"] = "com.atproto.label.defs#label"
+	result["CreatedAt"] = label.Cts
+	result["PulledTimestamp"] = time.Now().Format(time.RFC3339)
+	result["URI"] = label.Uri
+
+	full["_ActorDid"] = label.Src
+	projection["Actor"] = map[string]interface{}{"DID": label.Src}
+
+	if h.levelFor("com.atproto.label.defs#label") > HydrationNone {
+		identity, err := h.LookupIdentity(label.Src)
+		if err != nil {
+			log.Warnf("Failed to lookup identity for labeler %s: %s", label.Src, err)
+		} else {
+			full["_ActorIdentity"] = identity
+			flat, err := h.flattenIdentity(identity)
+			if err == nil {
+				projection["Actor"] = flat
+			}
+		}
+	}
+
+	projection["Label"] = h.flattenLabels([]*atproto.LabelDefs_Label{label})[0]
+
+	result["Full"] = full
+	result["Projection"] = projection
+
+	return result, nil
+}
+
+// Adds the projections that can be built from the record alone, without any
+// network calls.
+func (h *Hydrator) projectRecord(val interface{}, projection map[string]interface{}) {
+	switch val := val.(type) {
+	case *bsky.ActorProfile:
+		projection["Profile"] = h.flattenActorProfile(val)
+	case *bsky.FeedPost:
+		projection["Post"] = h.flattenPost(val)
+	case *bsky.GraphList:
+		projection["List"] = h.flattenList(val)
+	case *bsky.GraphListitem:
+		projection["ListItem"] = h.flattenListItem(val)
+	case *bsky.GraphListblock:
+		projection["ListBlock"] = h.flattenListBlock(val)
+	case *bsky.GraphStarterpack:
+		projection["Starterpack"] = h.flattenStarterpack(val)
+	case *bsky.FeedThreadgate:
+		projection["Threadgate"] = h.flattenThreadgate(val)
+	case *bsky.FeedPostgate:
+		projection["Postgate"] = h.flattenPostgate(val)
+	case *bsky.FeedGenerator:
+		projection["FeedGenerator"] = h.flattenFeedGenerator(val)
+	case *bsky.LabelerService:
+		projection["LabelerService"] = h.flattenLabelerService(val)
+	case *chat.ActorDeclaration:
+		projection["ChatDeclaration"] = h.flattenChatDeclaration(val)
+	}
+}
+
+// Looks up the subjects of likes, reposts, blocks, follows, list items, list
+// blocks and starter packs, and the accounts that posts mention.
+func (h *Hydrator) hydrateSubjects(val interface{}, full map[string]interface{}, projection map[string]interface{}) {
 	// Depending on the type, add additional information
 	switch val := val.(type) {
 	// For types, it can be helpful to look at https://github.com/bluesky-social/indigo/blob/49a1572716a6cccde22022c4264b62acbab43bc2/sonar/sonar.go#L227
+	case *bsky.FeedPost:
+		// Lookup the handles of everyone the post mentions
+		if flat, ok := projection["Post"].(map[string]interface{}); ok {
+			h.hydrateMentions(flat)
+		}
 	case *bsky.FeedLike:
 		// Lookup the actual post (basic author info will be included)
 		if val.Subject != nil {
@@ -576,6 +1313,7 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 			}
 			full["_LikedPost"] = post
 			projection["LikedPost"] = h.flattenPostView(post)
+			h.hydrateMentions(projection["LikedPost"].(map[string]interface{}))
 		} else {
 			log.Warn("No Subject in Like")
 		}
@@ -589,6 +1327,7 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 			}
 			full["_RepostedPost"] = post
 			projection["RepostedPost"] = h.flattenPostView(post)
+			h.hydrateMentions(projection["RepostedPost"].(map[string]interface{}))
 		} else {
 			log.Warn("No Subject in Repost")
 		}
@@ -610,15 +1349,111 @@ func (h *Hydrator) Hydrate(val interface{}, actorDid string) (result map[string]
 		}
 		full["_FollowedProfile"] = profile
 		projection["FollowedProfile"] = h.flattenFullProfile(profile)
-	case *bsky.ActorProfile:
-		projection["Profile"] = h.flattenActorProfile(val)
-	case *bsky.FeedPost:
-		projection["Post"] = h.flattenPost(val)
+	case *bsky.GraphListitem:
+		// Lookup the listed user and the list they were added to
+		profile, err := h.lookupProfile(val.Subject)
+		if err != nil {
+			log.Warnf("Failed to get profile for listed user: %s", val.Subject)
+			profile = nil
+		}
+		list, err := h.lookupList(val.List)
+		if err != nil {
+			log.Warnf("Failed to get list for list item: %s", val.List)
+			list = nil
+		}
+		full["_SubjectProfile"] = profile
+		full["_List"] = list
+		if flat, ok := projection["ListItem"].(map[string]interface{}); ok {
+			flat["SubjectProfile"] = h.flattenFullProfile(profile)
+			flat["List"] = h.flattenListView(list)
+		}
+	case *bsky.GraphListblock:
+		// Lookup the blocked list
+		list, err := h.lookupList(val.Subject)
+		if err != nil {
+			log.Warnf("Failed to get list for list block: %s", val.Subject)
+			list = nil
+		}
+		full["_List"] = list
+		if flat, ok := projection["ListBlock"].(map[string]interface{}); ok {
+			flat["List"] = h.flattenListView(list)
+		}
+	case *bsky.GraphStarterpack:
+		// Lookup the list of people in the starter pack
+		list, err := h.lookupList(val.List)
+		if err != nil {
+			log.Warnf("Failed to get list for starter pack: %s", val.List)
+			list = nil
+		}
+		full["_List"] = list
+		if flat, ok := projection["Starterpack"].(map[string]interface{}); ok {
+			flat["List"] = h.flattenListView(list)
+		}
 	}
+}
 
-	// Add the full object to the result
-	result["Full"] = full
-	result["Projection"] = projection
+// Looks up the posts that a post replies to or quotes.
+func (h *Hydrator) hydrateReferencedPosts(val interface{}, full map[string]interface{}, projection map[string]interface{}) {
+	post, ok := val.(*bsky.FeedPost)
+	if !ok {
+		return
+	}
 
-	return
+	flatPost, ok := projection["Post"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if post.Reply != nil {
+		if post.Reply.Parent != nil {
+			parent, err := h.lookupPost(post.Reply.Parent.Uri)
+			if err != nil {
+				log.Warnf("Failed to get reply parent: %s", post.Reply.Parent.Uri)
+				parent = nil
+			}
+			full["_ReplyParentPost"] = parent
+			flatPost["ReplyParent"] = h.flattenReferencedPost(parent)
+		}
+		if post.Reply.Root != nil {
+			root, err := h.lookupPost(post.Reply.Root.Uri)
+			if err != nil {
+				log.Warnf("Failed to get reply root: %s", post.Reply.Root.Uri)
+				root = nil
+			}
+			full["_ReplyRootPost"] = root
+			flatPost["ReplyRoot"] = h.flattenReferencedPost(root)
+		}
+	}
+
+	if quotedUri := quotedPostUri(post.Embed); quotedUri != "" {
+		quoted, err := h.lookupPost(quotedUri)
+		if err != nil {
+			log.Warnf("Failed to get quoted post: %s", quotedUri)
+			quoted = nil
+		}
+		full["_QuotedPost"] = quoted
+		flatPost["QuotedPost"] = h.flattenReferencedPost(quoted)
+	}
+}
+
+// Returns the URI of the post quoted by an embed, or "" if the embed doesn't
+// quote a post.
+func quotedPostUri(embed *bsky.FeedPost_Embed) string {
+	if embed == nil {
+		return ""
+	}
+
+	var uri string
+	if embed.EmbedRecord != nil && embed.EmbedRecord.Record != nil {
+		uri = embed.EmbedRecord.Record.Uri
+	} else if embed.EmbedRecordWithMedia != nil && embed.EmbedRecordWithMedia.Record != nil && embed.EmbedRecordWithMedia.Record.Record != nil {
+		uri = embed.EmbedRecordWithMedia.Record.Record.Uri
+	}
+
+	// Records can embed things other than posts (e.g., lists and feed generators)
+	if !strings.Contains(uri, "/app.bsky.feed.post/") {
+		return ""
+	}
+
+	return uri
 }
@@ -0,0 +1,66 @@
+package hydrator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HydrationLevel controls how much network work the hydrator does per record.
+type HydrationLevel int
+
+const (
+	HydrationNone  HydrationLevel = iota // Raw record, URI and actor DID; no network calls at all
+	HydrationActor                       // Adds the actor's identity
+	HydrationFull                        // Adds the actor's profile and the subjects of likes, reposts, follows, blocks and list records
+	HydrationDeep                        // Also resolves quoted posts and reply parents/roots
+)
+
+var hydrationLevelNames = map[string]HydrationLevel{
+	"none":  HydrationNone,
+	"actor": HydrationActor,
+	"full":  HydrationFull,
+	"deep":  HydrationDeep,
+}
+
+func ParseHydrationLevel(name string) (HydrationLevel, error) {
+	level, ok := hydrationLevelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return HydrationNone, fmt.Errorf("unknown hydration level %q (expected one of none, actor, full, deep)", name)
+	}
+	return level, nil
+}
+
+// ParseCollectionHydrationLevels parses overrides of the form
+// `app.bsky.feed.like=none`.
+func ParseCollectionHydrationLevels(overrides []string) (map[string]HydrationLevel, error) {
+	levels := make(map[string]HydrationLevel)
+	for _, override := range overrides {
+		collection, name, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected a collection hydration level of the form <collection>=<level>, got %q", override)
+		}
+		level, err := ParseHydrationLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(collection)] = level
+	}
+	return levels, nil
+}
+
+func (l HydrationLevel) String() string {
+	for name, level := range hydrationLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return fmt.Sprintf("HydrationLevel(%d)", int(l))
+}
+
+// Returns the hydration level to use for records in the given collection.
+func (h *Hydrator) levelFor(collection string) HydrationLevel {
+	if level, ok := h.CollectionLevels[collection]; ok {
+		return level
+	}
+	return h.Level
+}
@@ -0,0 +1,390 @@
+package hydrator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	atpidentity "github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/cockroachdb/pebble"
+	log "github.com/sirupsen/logrus"
+)
+
+// PersistentCache is an on-disk cache that sits behind the in-memory ristretto
+// cache. It survives restarts, so a warm restart doesn't have to re-fetch every
+// identity, profile and post that we already looked up.
+type PersistentCache struct {
+	DB      *pebble.DB
+	MaxSize int64         // Maximum size of the cache on disk, in bytes; zero means unbounded
+	TTL     time.Duration // How long entries live on disk before they are considered stale
+
+	lk     sync.RWMutex // Held for writing while closing, so that lookups don't race the DB going away
+	closed bool
+	done   chan struct{}  // Closed to stop enforcing limits
+	wg     sync.WaitGroup // For the goroutine enforcing limits
+}
+
+// Values are stored as JSON alongside their expiry. Errors are stored too, so
+// that we don't keep re-fetching e.g. suspended profiles: their message, the
+// sentinels they wrapped (by name) and, for XRPC errors, the status and error
+// name, so that what comes back works the same with errors.Is and errors.As.
+type persistentCacheEntry struct {
+	ExpiresAt   int64
+	Value       json.RawMessage `json:",omitempty"`
+	Error       string          `json:",omitempty"`
+	ErrorKinds  []string        `json:",omitempty"`
+	XRPCStatus  int             `json:",omitempty"`
+	XRPCError   string          `json:",omitempty"`
+	XRPCMessage string          `json:",omitempty"`
+}
+
+// Sentinel errors that lookups can fail with, by the name they're persisted as
+var persistentErrorKinds = []struct {
+	name string
+	err  error
+}{
+	{"did-not-found", atpidentity.ErrDIDNotFound},
+	{"did-resolution-failed", atpidentity.ErrDIDResolutionFailed},
+	{"handle-not-found", atpidentity.ErrHandleNotFound},
+	{"handle-resolution-failed", atpidentity.ErrHandleResolutionFailed},
+	{"handle-mismatch", atpidentity.ErrHandleMismatch},
+	{"handle-not-declared", atpidentity.ErrHandleNotDeclared},
+	{"handle-reserved-tld", atpidentity.ErrHandleReservedTLD},
+	{"key-not-declared", atpidentity.ErrKeyNotDeclared},
+	{"offline", ErrOffline},
+}
+
+// persistedError is an error read back from the persistent cache, with the
+// original's message, wrapping what the original wrapped (as far as we kept
+// track of it).
+type persistedError struct {
+	message string
+	wrapped []error
+}
+
+func (e *persistedError) Error() string {
+	return e.message
+}
+
+func (e *persistedError) Unwrap() []error {
+	return e.wrapped
+}
+
+func (entry *persistentCacheEntry) setError(err error) {
+	entry.Error = err.Error()
+	for _, kind := range persistentErrorKinds {
+		if errors.Is(err, kind.err) {
+			entry.ErrorKinds = append(entry.ErrorKinds, kind.name)
+		}
+	}
+	var xrpcErr *xrpc.Error
+	if errors.As(err, &xrpcErr) {
+		entry.XRPCStatus = xrpcErr.StatusCode
+		var wrapped *xrpc.XRPCError
+		if errors.As(xrpcErr.Wrapped, &wrapped) {
+			entry.XRPCError = wrapped.ErrStr
+			entry.XRPCMessage = wrapped.Message
+		}
+	}
+}
+
+func (entry *persistentCacheEntry) error() error {
+	err := persistedError{message: entry.Error}
+	for _, name := range entry.ErrorKinds {
+		for _, kind := range persistentErrorKinds {
+			if kind.name == name {
+				err.wrapped = append(err.wrapped, kind.err)
+			}
+		}
+	}
+	if entry.XRPCStatus != 0 {
+		xrpcErr := &xrpc.Error{StatusCode: entry.XRPCStatus}
+		if entry.XRPCError != "" || entry.XRPCMessage != "" {
+			xrpcErr.Wrapped = &xrpc.XRPCError{ErrStr: entry.XRPCError, Message: entry.XRPCMessage}
+		}
+		err.wrapped = append(err.wrapped, xrpcErr)
+	}
+	return &err
+}
+
+// Entries are stored under "v" followed by their key. Each also has an index
+// entry under "t", followed by its expiry (big-endian, so that they sort in
+// order) and its key, so that expired entries (and, as every entry lives for the
+// same TTL, the oldest ones) can be found without scanning everything.
+var (
+	persistentValuePrefix  = []byte("v")
+	persistentExpiryPrefix = []byte("t")
+	persistentFormatKey    = []byte("format")
+	persistentFormat       = []byte("2")
+)
+
+// When over its size cap, the cache evicts its oldest entries until it's this
+// far under it (going by the entries' sizes, as the space on disk is only
+// reclaimed as pebble compacts in the background)
+const persistentCacheEvictionHeadroom = 0.1
+
+func persistentValueKey(key []byte) []byte {
+	return append(append([]byte{}, persistentValuePrefix...), key...)
+}
+
+func persistentExpiryKey(expiresAt int64, key []byte) []byte {
+	k := append([]byte{}, persistentExpiryPrefix...)
+	k = binary.BigEndian.AppendUint64(k, uint64(expiresAt))
+	return append(k, key...)
+}
+
+func OpenPersistentCache(path string, maxSize int64, ttl time.Duration) (*PersistentCache, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open persistent cache at %s: %+v", path, err)
+	}
+
+	// Caches from before entries were indexed by expiry are dropped
+	format, closer, err := db.Get(persistentFormatKey)
+	if err == nil {
+		format = append([]byte{}, format...)
+		closer.Close()
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		db.Close()
+		return nil, fmt.Errorf("failed to open persistent cache at %s: %+v", path, err)
+	}
+	if !bytes.Equal(format, persistentFormat) {
+		batch := db.NewBatch()
+		if !isEmpty(db) {
+			log.Infof("Persistent cache at %s is in an old format, so starting it afresh", path)
+			batch.DeleteRange([]byte{}, []byte{0xff}, nil)
+		}
+		batch.Set(persistentFormatKey, persistentFormat, nil)
+		if err := batch.Commit(pebble.Sync); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to reset persistent cache at %s: %+v", path, err)
+		}
+	}
+
+	p := PersistentCache{
+		DB:      db,
+		MaxSize: maxSize,
+		TTL:     ttl,
+		done:    make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.enforceLimitsContinuously()
+
+	return &p, nil
+}
+
+func isEmpty(db *pebble.DB) bool {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return false
+	}
+	defer iter.Close()
+	return !iter.First()
+}
+
+// Reads the entry stored at key, if there is one
+func (p *PersistentCache) getEntry(key []byte) (*persistentCacheEntry, error) {
+	raw, closer, err := p.DB.Get(persistentValueKey(key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var entry persistentCacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Get decodes the entry stored at key into out. If the stored entry is a cached
+// error, it's returned as cachedErr. Expired entries are treated as misses.
+func (p *PersistentCache) Get(key string, out interface{}) (found bool, cachedErr error, err error) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	if p.closed {
+		return false, nil, nil
+	}
+
+	entry, err := p.getEntry([]byte(key))
+	if err != nil || entry == nil {
+		return false, nil, err
+	}
+
+	if entry.ExpiresAt < time.Now().Unix() {
+		return false, nil, nil
+	}
+
+	if entry.Error != "" {
+		return true, entry.error(), nil
+	}
+
+	if err := json.Unmarshal(entry.Value, out); err != nil {
+		return false, nil, err
+	}
+
+	return true, nil, nil
+}
+
+// Set stores value (or, if value is an error, its message) at key.
+func (p *PersistentCache) Set(key string, value interface{}) error {
+	entry := persistentCacheEntry{
+		ExpiresAt: time.Now().Add(p.TTL).Unix(),
+	}
+
+	if valueErr, isErr := value.(error); isErr {
+		entry.setError(valueErr)
+	} else {
+		marshalled, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		entry.Value = marshalled
+	}
+
+	marshalled, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	if p.closed {
+		return nil
+	}
+
+	batch := p.DB.NewBatch()
+	if err := p.deleteEntry(batch, []byte(key)); err != nil {
+		return err
+	}
+	batch.Set(persistentValueKey([]byte(key)), marshalled, nil)
+	batch.Set(persistentExpiryKey(entry.ExpiresAt, []byte(key)), nil, nil)
+	return batch.Commit(pebble.NoSync)
+}
+
+func (p *PersistentCache) Delete(key string) error {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	if p.closed {
+		return nil
+	}
+
+	batch := p.DB.NewBatch()
+	if err := p.deleteEntry(batch, []byte(key)); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.NoSync)
+}
+
+// Adds the deletion of the entry at key (and its index entry) to a batch
+func (p *PersistentCache) deleteEntry(batch *pebble.Batch, key []byte) error {
+	entry, err := p.getEntry(key)
+	if err != nil || entry == nil {
+		return err
+	}
+	batch.Delete(persistentValueKey(key), nil)
+	batch.Delete(persistentExpiryKey(entry.ExpiresAt, key), nil)
+	return nil
+}
+
+// Close stops enforcing limits and closes the DB. Lookups after that miss, and
+// writes are dropped.
+func (p *PersistentCache) Close() error {
+	close(p.done)
+	p.wg.Wait()
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.closed = true
+	return p.DB.Close()
+}
+
+func (p *PersistentCache) enforceLimitsContinuously() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-time.After(5 * time.Minute):
+		case <-p.done:
+			return
+		}
+
+		expired, err := p.evictOldest(time.Now().Unix(), 0)
+		if err != nil {
+			log.Errorf("Failed to delete expired entries from persistent cache: %+v", err)
+		}
+		log.Debugf("Deleted %d expired entries from persistent cache", expired)
+
+		usage := int64(p.DB.Metrics().DiskSpaceUsage())
+		if p.MaxSize > 0 && usage > p.MaxSize {
+			excess := usage - p.MaxSize + int64(float64(p.MaxSize)*persistentCacheEvictionHeadroom)
+			evicted, err := p.evictOldest(0, excess)
+			if err != nil {
+				log.Errorf("Failed to evict entries from persistent cache: %+v", err)
+			}
+			log.Infof("Persistent cache was over its size cap (%d > %d bytes), so evicted its %d oldest entries", usage, p.MaxSize, evicted)
+		}
+	}
+}
+
+// Deletes the oldest entries: those that expired before expiredBefore (if
+// given), or else enough for their sizes to add up to size. The index entries
+// are checked against the entries they point at, as an entry that was set again
+// may have left a stale one behind.
+func (p *PersistentCache) evictOldest(expiredBefore int64, size int64) (int, error) {
+	upper := persistentExpiryKey(expiredBefore, nil)
+	if expiredBefore == 0 {
+		upper = []byte{persistentExpiryPrefix[0] + 1}
+	}
+	iter, err := p.DB.NewIter(&pebble.IterOptions{
+		LowerBound: persistentExpiryPrefix,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	batch := p.DB.NewBatch()
+	evicted := 0
+	var freed int64
+	for iter.First(); iter.Valid(); iter.Next() {
+		if expiredBefore == 0 && freed >= size {
+			break
+		}
+
+		indexKey := iter.Key()
+		expiresAt := int64(binary.BigEndian.Uint64(indexKey[len(persistentExpiryPrefix):]))
+		key := indexKey[len(persistentExpiryPrefix)+8:]
+
+		batch.Delete(indexKey, nil)
+		freed += int64(len(indexKey))
+
+		valueKey := persistentValueKey(key)
+		raw, closer, err := p.DB.Get(valueKey)
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return evicted, err
+		}
+		var entry persistentCacheEntry
+		if json.Unmarshal(raw, &entry) != nil || entry.ExpiresAt == expiresAt {
+			batch.Delete(valueKey, nil)
+			freed += int64(len(valueKey) + len(raw))
+			evicted++
+		}
+		closer.Close()
+	}
+
+	return evicted, batch.Commit(pebble.NoSync)
+}
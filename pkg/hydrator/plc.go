@@ -0,0 +1,227 @@
+package hydrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An entry in a DID's PLC audit log (https://plc.directory/<did>/log/audit)
+type PLCAuditEntry struct {
+	DID       string       `json:"did"`
+	CID       string       `json:"cid"`
+	Nullified bool         `json:"nullified"`
+	CreatedAt string       `json:"createdAt"`
+	Operation PLCOperation `json:"operation"`
+}
+
+// A PLC operation. This covers current operations ("plc_operation"),
+// tombstones ("plc_tombstone") and the legacy "create" operation, which has its
+// own (flat) set of fields.
+type PLCOperation struct {
+	Type                string                `json:"type"`
+	AlsoKnownAs         []string              `json:"alsoKnownAs,omitempty"`
+	RotationKeys        []string              `json:"rotationKeys,omitempty"`
+	VerificationMethods map[string]string     `json:"verificationMethods,omitempty"`
+	Services            map[string]PLCService `json:"services,omitempty"`
+
+	// Legacy "create" fields
+	Handle      string `json:"handle,omitempty"`
+	Service     string `json:"service,omitempty"`
+	SigningKey  string `json:"signingKey,omitempty"`
+	RecoveryKey string `json:"recoveryKey,omitempty"`
+}
+
+type PLCService struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+}
+
+// The parts of an identity that we track changes to
+type plcIdentityState struct {
+	Handle       string
+	PDS          string
+	SigningKey   string
+	RotationKeys string
+	Tombstoned   bool
+}
+
+func (op *PLCOperation) state() plcIdentityState {
+	if op.Type == "plc_tombstone" {
+		return plcIdentityState{Tombstoned: true}
+	}
+
+	if op.Type == "create" {
+		return plcIdentityState{
+			Handle:       op.Handle,
+			PDS:          op.Service,
+			SigningKey:   op.SigningKey,
+			RotationKeys: op.RecoveryKey,
+		}
+	}
+
+	state := plcIdentityState{
+		SigningKey:   op.VerificationMethods["atproto"],
+		RotationKeys: strings.Join(op.RotationKeys, " "),
+	}
+	for _, aka := range op.AlsoKnownAs {
+		if strings.HasPrefix(aka, "at://") {
+			state.Handle = strings.TrimPrefix(aka, "at://")
+			break
+		}
+	}
+	if pds, ok := op.Services["atproto_pds"]; ok {
+		state.PDS = pds.Endpoint
+	}
+
+	return state
+}
+
+// LookupPLCAuditLog fetches the full operation log of a did:plc DID.
+func (h *Hydrator) LookupPLCAuditLog(did string) (entries []PLCAuditEntry, err error) {
+	if !strings.HasPrefix(did, "did:plc:") {
+		return nil, fmt.Errorf("%s is not a did:plc DID, so it has no PLC audit log", did)
+	}
+
+	key := namespaceKey("plc-audit", did)
+
+	// Check the cache first
+	cachedValue, cachedError, found := cacheGet[[]PLCAuditEntry](h, key)
+
+	if found {
+		if cachedError != nil {
+			log.Debugf("Cached error for %s: %v", did, cachedError)
+			return nil, cachedError
+		}
+		return cachedValue, nil
+	}
+
+	if h.Offline {
+		return nil, fmt.Errorf("PLC audit log for %s: %w", did, ErrOffline)
+	}
+
+	h.Ratelimit.Take()
+	resp, err := h.PLCClient.Get(fmt.Sprintf("%s/%s/log/audit", h.PLCHost, did))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status fetching PLC audit log for %s: %s", did, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			h.cacheSet(key, err)
+		}
+		return nil, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	h.cacheSet(key, entries)
+
+	return entries, nil
+}
+
+// LookupIdentityHistory turns a DID's PLC audit log into a list of changes:
+// handle changes, PDS migrations, signing and rotation key changes, and
+// tombstones. The first entry (Kind "created") describes the initial state.
+func (h *Hydrator) LookupIdentityHistory(did string) (changes []map[string]interface{}, err error) {
+	entries, err := h.LookupPLCAuditLog(did)
+	if err != nil {
+		return nil, err
+	}
+
+	// The log should already be in order, but let's not rely on it (and copy it
+	// first, since the cache hands everyone the same slice)
+	entries = append([]PLCAuditEntry{}, entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt < entries[j].CreatedAt
+	})
+
+	changes = make([]map[string]interface{}, 0)
+	var previous *plcIdentityState
+	for _, entry := range entries {
+		// Nullified operations were overridden by a rotation key with higher
+		// priority, so they never really took effect
+		if entry.Nullified {
+			continue
+		}
+
+		current := entry.Operation.state()
+		change := func(kind string, before string, after string) {
+			changes = append(changes, map[string]interface{}{
+				"Kind":      kind,
+				"Before":    before,
+				"After":     after,
+				"CreatedAt": entry.CreatedAt,
+				"CID":       entry.CID,
+			})
+		}
+
+		if previous == nil {
+			change("created", "", current.Handle)
+		} else if current.Tombstoned {
+			change("tombstone", previous.Handle, "")
+		} else {
+			if current.Handle != previous.Handle {
+				change("handle", previous.Handle, current.Handle)
+			}
+			if current.PDS != previous.PDS {
+				change("pds", previous.PDS, current.PDS)
+			}
+			if current.SigningKey != previous.SigningKey {
+				change("signing-key", previous.SigningKey, current.SigningKey)
+			}
+			if current.RotationKeys != previous.RotationKeys {
+				change("rotation-keys", previous.RotationKeys, current.RotationKeys)
+			}
+		}
+
+		previous = &current
+	}
+
+	return changes, nil
+}
+
+// HydrateIdentityHistory returns one output row per change in a DID's identity
+// history, in the same shape as a hydrated record.
+func (h *Hydrator) HydrateIdentityHistory(did string) (results []map[string]interface{}, err error) {
+	changes, err := h.LookupIdentityHistory(did)
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		result := make(map[string]interface{})
+		result["Type"] = "plc.identityChange"
+		result["Action"] = change["Kind"]
+		result["CreatedAt"] = change["CreatedAt"]
+		result["PulledTimestamp"] = time.Now().Format(time.RFC3339)
+		result["URI"] = did
+		// Outputs may rewrite projections in place, so Full gets its own copy
+		fullChange := make(map[string]interface{}, len(change))
+		for k, v := range change {
+			fullChange[k] = v
+		}
+		result["Full"] = map[string]interface{}{
+			"_ActorDid": did,
+			"Change":    fullChange,
+		}
+		result["Projection"] = map[string]interface{}{
+			"Actor":          map[string]interface{}{"DID": did},
+			"IdentityChange": change,
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,250 @@
+package hydrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	atpidentity "github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalLookup is a source of identities and profiles that the hydrator
+// consults before making any network calls (e.g., a Snapshot). Lookups report
+// whether they found anything; a miss falls through to the network, unless the
+// hydrator is Offline.
+type LocalLookup interface {
+	LookupIdentity(identifier string) (*atpidentity.Identity, bool)
+	LookupProfile(did string) (*bsky.ActorDefs_ProfileViewDetailed, bool)
+}
+
+// Returned (wrapped) by lookups that would need the network when the hydrator
+// is Offline
+var ErrOffline = errors.New("not available locally, and network lookups are disabled")
+
+// Snapshot resolves identities and profiles from local files instead of the
+// network:
+//
+//   - a census file (from the census command), which limits the snapshot to
+//     the DIDs it lists, so that a full PLC export fits in memory
+//   - a PLC export (https://plc.directory/export, as JSON lines), from which
+//     each DID's current handle, PDS and signing key are taken
+//   - repos (e.g., the CARs being hydrated), from which profile records are
+//     taken (counts aren't, since they'd mean reading every repo in full)
+//
+// Handles are taken as claimed in the PLC export; unlike with the network
+// directory, they aren't verified against DNS or the handle's well-known
+// endpoint.
+type Snapshot struct {
+	lk         sync.RWMutex
+	dids       map[string]bool // DIDs from the census; nil if there's no census
+	identities map[string]plcIdentityState
+	handles    map[string]string             // Handle -> DID
+	profiles   map[string]*bsky.ActorProfile // Empty for repos without a profile record
+}
+
+var _ LocalLookup = (*Snapshot)(nil)
+
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		identities: make(map[string]plcIdentityState),
+		handles:    make(map[string]string),
+		profiles:   make(map[string]*bsky.ActorProfile),
+	}
+}
+
+// Opens a JSON lines file and calls cb with each (non-empty) line.
+func readJSONLines(path string, cb func(line []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024) // PLC operations can be long
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		if err := cb(line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// LoadCensus restricts the snapshot to the DIDs in a census file. Load it
+// before the PLC export, so that identities outside the census are skipped.
+func (s *Snapshot) LoadCensus(path string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.dids == nil {
+		s.dids = make(map[string]bool)
+	}
+
+	err := readJSONLines(path, func(line []byte) error {
+		var entry struct{ Did string }
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("failed to parse census entry: %w", err)
+		}
+		s.dids[entry.Did] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Loaded %d DIDs from census %s", len(s.dids), path)
+
+	return nil
+}
+
+// LoadPLCExport reads a PLC export. Operations are applied in the order they
+// appear (which is the order the PLC directory exports them in), so each DID
+// ends up with its latest state.
+func (s *Snapshot) LoadPLCExport(path string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	operations := 0
+	err := readJSONLines(path, func(line []byte) error {
+		var entry PLCAuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("failed to parse PLC operation: %w", err)
+		}
+		operations++
+
+		if entry.Nullified || (s.dids != nil && !s.dids[entry.DID]) {
+			return nil
+		}
+
+		if previous, ok := s.identities[entry.DID]; ok && s.handles[strings.ToLower(previous.Handle)] == entry.DID {
+			delete(s.handles, strings.ToLower(previous.Handle))
+		}
+
+		state := entry.Operation.state()
+		s.identities[entry.DID] = state
+		if state.Handle != "" {
+			s.handles[strings.ToLower(state.Handle)] = entry.DID
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Loaded %d identities from %d PLC operations in %s", len(s.identities), operations, path)
+
+	return nil
+}
+
+// AddRepo takes the profile record from a repo, reading nothing else.
+func (s *Snapshot) AddRepo(ctx context.Context, r *repo.Repo) error {
+	profile := &bsky.ActorProfile{}
+	if _, rec, err := r.GetRecord(ctx, "app.bsky.actor.profile/self"); err == nil {
+		if record, ok := rec.(*bsky.ActorProfile); ok {
+			profile = record
+		}
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.profiles[r.RepoDid()] = profile
+
+	return nil
+}
+
+func (s *Snapshot) LookupIdentity(identifier string) (*atpidentity.Identity, bool) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	did := identifier
+	if !strings.HasPrefix(identifier, "did:") {
+		var ok bool
+		did, ok = s.handles[strings.ToLower(identifier)]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	state, ok := s.identities[did]
+	if !ok || state.Tombstoned {
+		return nil, false
+	}
+
+	identity := &atpidentity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.HandleInvalid,
+	}
+	if handle, err := syntax.ParseHandle(state.Handle); err == nil {
+		identity.Handle = handle.Normalize()
+		identity.AlsoKnownAs = []string{"at://" + state.Handle}
+	}
+	if state.PDS != "" {
+		identity.Services = map[string]atpidentity.Service{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: state.PDS},
+		}
+	}
+	if strings.HasPrefix(state.SigningKey, "did:key:") {
+		identity.Keys = map[string]atpidentity.Key{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: strings.TrimPrefix(state.SigningKey, "did:key:")},
+		}
+	}
+
+	return identity, true
+}
+
+// LookupProfile builds a profile view like the one the AppView would return,
+// from the actor's profile record (without counts, which the snapshot doesn't
+// have).
+// Avatars and banners point at the CDN, as they do in the AppView, but nothing
+// is fetched.
+func (s *Snapshot) LookupProfile(did string) (*bsky.ActorDefs_ProfileViewDetailed, bool) {
+	identity, ok := s.LookupIdentity(did)
+	if !ok {
+		return nil, false
+	}
+
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	// Accounts without a profile record still have a (mostly empty) profile,
+	// as long as we've seen their repo
+	record, ok := s.profiles[did]
+	if !ok {
+		return nil, false
+	}
+
+	profile := &bsky.ActorDefs_ProfileViewDetailed{
+		Did:         did,
+		Handle:      identity.Handle.String(),
+		DisplayName: record.DisplayName,
+		Description: record.Description,
+		CreatedAt:   record.CreatedAt,
+		PinnedPost:  record.PinnedPost,
+	}
+	if record.Avatar != nil {
+		avatar := fmt.Sprintf("https://cdn.bsky.app/img/avatar/plain/%s/%s@jpeg", did, record.Avatar.Ref.String())
+		profile.Avatar = &avatar
+	}
+	if record.Banner != nil {
+		banner := fmt.Sprintf("https://cdn.bsky.app/img/banner/plain/%s/%s@jpeg", did, record.Banner.Ref.String())
+		profile.Banner = &banner
+	}
+
+	return profile, true
+}
@@ -0,0 +1,280 @@
+package labels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/hydrator"
+	"github.com/stanfordio/skyfall/pkg/output"
+)
+
+type LabelStream struct {
+	// Services are the DIDs (or handles) of the labelers to subscribe to
+	Services        []string
+	Output          chan map[string]interface{}
+	Tracker         *output.Tracker // If set, rows are sent through it, and cursors only move once their rows are written
+	Hydrator        *hydrator.Hydrator
+	CursorStatePath string           // File to store each labeler's cursor in, so that we can backfill after a restart
+	BackfillSeq     map[string]int64 // Cursors to start from, keyed by labeler DID; overrides the cursor state file
+	Autorestart     bool
+
+	cursors     map[string]int64
+	held        map[string]bool // Labelers whose rows failed to be written, so whose cursors stay put
+	cursorsLock sync.Mutex
+}
+
+func (s *LabelStream) BeginStreaming(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err := s.loadCursorsFromDisk()
+	if err != nil {
+		log.Errorf("Failed to load label cursors from disk: %v", err)
+		return err
+	}
+	for did, seq := range s.BackfillSeq {
+		s.cursors[did] = seq
+	}
+
+	go s.keepCursorsSaved(ctx)
+
+	var wg sync.WaitGroup
+	for _, service := range s.Services {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			for {
+				err := s.streamService(ctx, service)
+				log.Errorf("Label stream from %s ended unexpectedly: %+v", service, err)
+
+				if !s.Autorestart || ctx.Err() != nil {
+					break
+				}
+
+				log.Infof("Restarting label stream from %s in 5 seconds...", service)
+				time.Sleep(5 * time.Second)
+			}
+		}(service)
+	}
+
+	wg.Wait()
+	log.Infof("All label streams have ended")
+
+	// Make sure we don't lose the most recent cursors
+	if err := s.saveCursorsToDisk(); err != nil {
+		log.Errorf("Failed to save label cursors to disk: %v", err)
+	}
+
+	return nil
+}
+
+// Finds the websocket URL of a labeler's subscribeLabels endpoint from its DID
+// document.
+func (s *LabelStream) resolveSocketURL(service string) (did string, socketURL *url.URL, err error) {
+	identity, err := s.Hydrator.LookupIdentity(service)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve labeler %s: %w", service, err)
+	}
+
+	endpoint := identity.GetServiceEndpoint("atproto_labeler")
+	if endpoint == "" {
+		return "", nil, fmt.Errorf("%s does not declare a labeler service endpoint", service)
+	}
+
+	socketURL, err = url.Parse(endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch socketURL.Scheme {
+	case "https":
+		socketURL.Scheme = "wss"
+	case "http":
+		socketURL.Scheme = "ws"
+	}
+	socketURL.Path = strings.TrimSuffix(socketURL.Path, "/") + "/xrpc/com.atproto.label.subscribeLabels"
+
+	return identity.DID.String(), socketURL, nil
+}
+
+func (s *LabelStream) streamService(ctx context.Context, service string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	did, socketURL, err := s.resolveSocketURL(service)
+	if err != nil {
+		return err
+	}
+
+	if seq := s.getCursor(did); seq > 0 {
+		query := socketURL.Query()
+		query.Set("cursor", fmt.Sprintf("%d", seq))
+		socketURL.RawQuery = query.Encode()
+	}
+
+	log.Infof("Connecting to label stream at: %s", socketURL.String())
+	c, _, err := websocket.DefaultDialer.Dial(socketURL.String(), http.Header{
+		"User-Agent": []string{"skyfall/1.0"},
+	})
+	if err != nil {
+		log.Infof("Failed to connect to websocket: %v", err)
+		return err
+	}
+	defer c.Close()
+
+	callbacks := &events.RepoStreamCallbacks{
+		LabelLabels: func(evt *comatproto.LabelSubscribeLabels_Labels) error {
+			return s.handleLabels(did, evt)
+		},
+		LabelInfo: func(evt *comatproto.LabelSubscribeLabels_Info) error {
+			log.Infof("Info from label stream %s: %s", did, evt.Name)
+			return nil
+		},
+	}
+
+	// Labels are handled in order so that the cursor we save is always safe to
+	// resume from
+	scheduler := sequential.NewScheduler(did, callbacks.EventHandler)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	return events.HandleRepoStream(ctx, c, scheduler, logger)
+}
+
+func (s *LabelStream) handleLabels(labelerDid string, evt *comatproto.LabelSubscribeLabels_Labels) error {
+	var rows *output.Batch
+	if s.Tracker != nil {
+		rows = s.Tracker.NewBatch()
+	}
+	sent := false
+
+	for _, label := range evt.Labels {
+		if label == nil {
+			continue
+		}
+
+		hydrated, err := s.Hydrator.HydrateLabel(label)
+		if err != nil {
+			log.Errorf("Failed to hydrate label: %+v", err)
+			continue
+		}
+
+		// Include the labeler's sequence number (note that this is per-labeler!)
+		hydrated["Seq"] = evt.Seq
+		hydrated["Action"] = "label"
+
+		if rows != nil {
+			rows.Send(hydrated)
+			sent = true
+		} else {
+			s.Output <- hydrated
+		}
+	}
+
+	if rows == nil {
+		s.setCursor(labelerDid, evt.Seq)
+		return nil
+	}
+
+	// The cursor only moves past the labels once they've been written. Events
+	// without any rows leave it where it is, since rows before them may not
+	// have been written yet (it moves past them with the next event's rows).
+	if sent {
+		rows.Close(func(written bool) {
+			if !written {
+				log.Errorf("Failed to write labels from %s at seq %d, so resuming from before them next time", labelerDid, evt.Seq)
+				s.holdCursor(labelerDid)
+				return
+			}
+			s.setCursor(labelerDid, evt.Seq)
+		})
+	}
+	return nil
+}
+
+func (s *LabelStream) getCursor(did string) int64 {
+	s.cursorsLock.Lock()
+	defer s.cursorsLock.Unlock()
+	return s.cursors[did]
+}
+
+func (s *LabelStream) setCursor(did string, seq int64) {
+	s.cursorsLock.Lock()
+	defer s.cursorsLock.Unlock()
+	if !s.held[did] {
+		s.cursors[did] = seq
+	}
+}
+
+func (s *LabelStream) holdCursor(did string) {
+	s.cursorsLock.Lock()
+	defer s.cursorsLock.Unlock()
+	s.held[did] = true
+}
+
+func (s *LabelStream) loadCursorsFromDisk() error {
+	s.cursors = make(map[string]int64)
+	s.held = make(map[string]bool)
+
+	if s.CursorStatePath == "" {
+		return nil
+	}
+
+	// If the file exists, load it
+	if _, err := os.Stat(s.CursorStatePath); err == nil {
+		in, err := os.ReadFile(s.CursorStatePath)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(in, &s.cursors)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *LabelStream) saveCursorsToDisk() error {
+	if s.CursorStatePath == "" {
+		return nil
+	}
+
+	s.cursorsLock.Lock()
+	out, err := json.Marshal(s.cursors)
+	s.cursorsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.CursorStatePath, out, 0644)
+}
+
+func (s *LabelStream) keepCursorsSaved(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.saveCursorsToDisk(); err != nil {
+				log.Errorf("Failed to save label cursors to disk: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
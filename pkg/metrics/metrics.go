@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Firehose
+
+	Events = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_events_total",
+		Help: "Records handled from the firehose (or a replay), by collection and action",
+	}, []string{"collection", "action"})
+
+	FirehoseSeq = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "skyfall_firehose_seq",
+		Help: "Seq of the most recent firehose event handled",
+	})
+
+	FirehoseLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "skyfall_firehose_lag_seconds",
+		Help: "Wall-clock time between the most recent firehose event's commit time and when it was handled",
+	})
+
+	ShardSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "skyfall_firehose_shard_skipped_total",
+		Help: "Firehose commits skipped because their actors belong to other shards",
+	})
+
+	// Hydration
+
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_hydrator_cache_lookups_total",
+		Help: "Hydrator cache lookups, by namespace (identity, profile, post, ...) and result (hit or miss)",
+	}, []string{"namespace", "result"})
+
+	RateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "skyfall_ratelimit_wait_seconds",
+		Help:    "Time spent waiting on per-host rate limits, by host",
+		Buckets: []float64{0.0001, 0.001, 0.01, 0.1, 0.5, 1, 5, 30},
+	}, []string{"host"})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "skyfall_breaker_state",
+		Help: "Circuit breaker state, by host (0 closed, 1 half-open, 2 open)",
+	}, []string{"host"})
+
+	BreakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_breaker_rejected_total",
+		Help: "Requests failed fast because their host's circuit breaker was open, by host",
+	}, []string{"host"})
+
+	// Outputs
+
+	SinkFlushLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "skyfall_sink_flush_seconds",
+		Help:    "Time taken to write a batch of rows to an output, by sink",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sink"})
+
+	SinkRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_sink_rows_total",
+		Help: "Rows written to an output, by sink",
+	}, []string{"sink"})
+
+	SinkErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_sink_errors_total",
+		Help: "Failed writes to an output, by sink",
+	}, []string{"sink"})
+
+	DedupRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_dedup_rows_total",
+		Help: "Rows checked by an output's dedup stage, by sink and result (unique or duplicate)",
+	}, []string{"sink", "result"})
+
+	// Pull
+
+	PullDIDs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skyfall_pull_dids_total",
+		Help: "DIDs pulled, by status (done or failed)",
+	}, []string{"status"})
+
+	PullDIDsRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "skyfall_pull_dids_remaining",
+		Help: "DIDs in the census that haven't been pulled yet",
+	})
+
+	PullDIDsDeferred = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "skyfall_pull_dids_deferred",
+		Help: "DIDs waiting for a retry pass because their hosts' circuit breakers were open",
+	})
+
+	PullLeases = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "skyfall_pull_leases",
+		Help: "Census ranges a pull coordinator has, by state (available, leased or done)",
+	}, []string{"state"})
+
+	PullLeasesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "skyfall_pull_leases_expired_total",
+		Help: "Leases on census ranges that expired without being renewed, so were leased again",
+	})
+)
+
+// The output channel whose depth is reported (see WatchOutputChannel)
+var watchedOutputChannel atomic.Pointer[chan map[string]interface{}]
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "skyfall_output_channel_depth",
+	Help: "Rows waiting in the output channel",
+}, func() float64 {
+	ch := watchedOutputChannel.Load()
+	if ch == nil {
+		return 0
+	}
+	return float64(len(*ch))
+})
+
+// WatchOutputChannel reports the depth of a command's output channel (i.e.,
+// rows that have been hydrated but not yet written), in place of whichever
+// channel was watched before.
+func WatchOutputChannel(ch chan map[string]interface{}) {
+	watchedOutputChannel.Store(&ch)
+}
+
+// CacheLookup records a hit or miss in a hydrator cache namespace.
+func CacheLookup(namespace string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheLookups.WithLabelValues(namespace, result).Inc()
+}
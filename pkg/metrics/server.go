@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Health and readiness, for orchestrators:
+//
+//   - /healthz fails once nothing has made progress (i.e., handled an event or
+//     written a row) for longer than the stall timeout, so that a stalled
+//     command can be restarted
+//   - /readyz succeeds once every component that reports readiness (e.g., the
+//     firehose connection and the output) is ready
+
+var (
+	lastProgress atomic.Int64 // Unix nanoseconds
+
+	readyLk sync.Mutex
+	ready   = make(map[string]bool)
+)
+
+// Progress records that something useful just happened.
+func Progress() {
+	lastProgress.Store(time.Now().UnixNano())
+}
+
+// SetReady records whether a component (e.g., "firehose" or "output") is ready.
+func SetReady(component string, isReady bool) {
+	readyLk.Lock()
+	defer readyLk.Unlock()
+	ready[component] = isReady
+}
+
+// Serve exposes /metrics, /healthz and /readyz on addr (e.g., ":9090"). It
+// only returns if the server fails.
+func Serve(addr string, stallTimeout time.Duration) error {
+	// Commands get until the stall timeout to make their first progress
+	Progress()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		since := time.Since(time.Unix(0, lastProgress.Load()))
+		if stallTimeout > 0 && since > stallTimeout {
+			http.Error(w, fmt.Sprintf("stalled: no progress for %s", since.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok: last progress %s ago\n", since.Round(time.Millisecond))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyLk.Lock()
+		components := make([]string, 0, len(ready))
+		allReady := len(ready) > 0
+		for component, isReady := range ready {
+			components = append(components, fmt.Sprintf("%s: %t", component, isReady))
+			allReady = allReady && isReady
+		}
+		readyLk.Unlock()
+		sort.Strings(components)
+
+		status := http.StatusOK
+		if !allReady {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		for _, component := range components {
+			fmt.Fprintln(w, component)
+		}
+	})
+
+	log.Infof("Serving metrics and health checks on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -13,7 +13,10 @@ import (
 	"cloud.google.com/go/bigquery/storage/managedwriter"
 	adapt "cloud.google.com/go/bigquery/storage/managedwriter/adapt"
 	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/metrics"
 	bq_schema "github.com/stanfordio/skyfall/pkg/output/bq/schema"
+	"github.com/stanfordio/skyfall/pkg/output/buffer"
+	"github.com/stanfordio/skyfall/pkg/shard"
 	"google.golang.org/api/iterator"
 	"google.golang.org/protobuf/encoding/protojson"   
 	"google.golang.org/protobuf/proto"
@@ -22,11 +25,18 @@ import (
 	"google.golang.org/protobuf/types/dynamicpb"
 )
 
+// Longest a row waits in the buffer before it's flushed, so that the last rows
+// of a burst (e.g., a CAR's or a lease's) are written without waiting for more
+const flushInterval = 10 * time.Second
+
 type BQ struct {
 	Context       context.Context
 	Client        *bigquery.Client
 	OutputTable   *bigquery.Table
 	OutputChannel chan map[string]interface{}
+
+	// Acknowledge, if set, is told whether each row was written, in order
+	Acknowledge func(written bool)
 }
 
 func New(ctx context.Context, tablePath string, outputChannel chan map[string]interface{}) (*BQ, error) {
@@ -143,8 +153,14 @@ func (bq BQ) Setup() error {
 	return nil
 }
 
-func (bq BQ) GetBackfillSeqno() (int64, error) {
+// GetBackfillSeqno is the table's highest seq or, when sharding, the highest
+// seq among the shard's rows (since shards may share a table), hashing actors'
+// DIDs as shard.Hash does.
+func (bq BQ) GetBackfillSeqno(s shard.Shard) (int64, error) {
 	query := fmt.Sprintf("SELECT MAX(Seq) as max_seq FROM `%s.%s.%s`", bq.OutputTable.ProjectID, bq.OutputTable.DatasetID, bq.OutputTable.TableID)
+	if s.Sharded() {
+		query += fmt.Sprintf(" WHERE MOD(CAST(CONCAT('0x', TO_HEX(SUBSTR(SHA256(Projection.Actor.DID), 1, 4))) AS INT64), %d) = %d", s.Count, s.Index)
+	}
 	log.Infof("Running query: %s", query)
 	result := bq.Client.Query(query)
 	it, err := result.Read(context.Background())
@@ -195,8 +211,15 @@ func cleanOutput(value map[string]interface{}) map[string]interface{} {
 			value[k] = cleanOutput(subMap)
 		}
 
+		// Recursively clean repeated records (e.g., labels), which are lists of maps
+		if subMaps, ok := v.([]map[string]interface{}); ok {
+			for i := range subMaps {
+				subMaps[i] = cleanOutput(subMaps[i])
+			}
+		}
+
 		// Handle specific fields like timestamps
-		if k == "CreatedAt" || k == "PulledTimestamp" || k == "IndexedAt" {
+		if k == "CreatedAt" || k == "PulledTimestamp" || k == "IndexedAt" || k == "ExpiresAt" {
 			value[k] = parseTimestamp(value[k])
 		}
 
@@ -278,6 +301,10 @@ func prepareForWrite(value map[string]interface{}) ([]byte, error) {
 	return json.Marshal(cleaned)
 }
 
+func (bq BQ) Close() error {
+	return bq.Client.Close()
+}
+
 // Streams data to BigQuery
 func (bq BQ) StreamOutput(ctx context.Context) error {
 	log.Infof("Starting to stream output to BigQuery table: %+v", bq.OutputTable.FullyQualifiedName())
@@ -309,35 +336,31 @@ func (bq BQ) StreamOutput(ctx context.Context) error {
 		log.Errorf("Failed to create managed stream: %v", err)
 		return err
 	}
+	metrics.SetReady("output", true)
+	defer metrics.SetReady("output", false)
 
 	// Stream processing loop
-	var buffer []map[string]interface{}
-	for {
-		select {
-		case value, ok := <-bq.OutputChannel:
-			if !ok {
-				log.Info("Channel closed, exiting.")
-				return nil
-			}
-			buffer = append(buffer, value)
-
-			// Flush if buffer size reaches threshold
-			if len(buffer) >= 250 {
-				if err := bq.flushBuffer(ctx, managedStream, messageDescriptor, buffer); err != nil {
-					log.Errorf("Failed to flush buffer: %v", err)
-					continue
-				} else {
-					// Log the number of rows uploaded to BigQuery
-					log.Infof("Buffer flushed! Rows uploaded: %d", len(buffer))
-				}
-				buffer = nil // Clear the buffer after flushing
+	buffered := buffer.Buffer{
+		Size:     250,
+		MaxDelay: flushInterval,
+		Flush: func(ctx context.Context, rows []map[string]interface{}) error {
+			if err := bq.flushBuffer(ctx, managedStream, messageDescriptor, rows); err != nil {
+				return err
 			}
-
-		case <-ctx.Done():
-			log.Warn("Context canceled, stopping.")
-			return ctx.Err()
-		}
+			// Log the number of rows uploaded to BigQuery
+			log.Infof("Buffer flushed! Rows uploaded: %d", len(rows))
+			return nil
+		},
+		// Rows that couldn't be prepared were skipped for good, so they count
+		// as written too
+		Acknowledge: bq.Acknowledge,
 	}
+	if err := buffered.Run(ctx, bq.OutputChannel); err != nil {
+		log.Warnf("Stopped streaming to BigQuery: %v", err)
+		return err
+	}
+	log.Info("Channel closed, exiting.")
+	return nil
 }
 
 func (bq BQ) flushBuffer(ctx context.Context, managedStream *managedwriter.ManagedStream, descriptor protoreflect.MessageDescriptor, buffer []map[string]interface{}) error {
@@ -368,13 +391,22 @@ func (bq BQ) flushBuffer(ctx context.Context, managedStream *managedwriter.Manag
 		return nil
 	}
 
+	start := time.Now()
 	result, err := managedStream.AppendRows(ctx, encodedRows)
 	if err != nil {
+		metrics.SinkErrors.WithLabelValues("bigquery").Inc()
 		return fmt.Errorf("failed to append rows: %w", err)
 	}
 
 	_, err = result.GetResult(ctx)
-	return err
+	metrics.SinkFlushLatency.WithLabelValues("bigquery").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.SinkErrors.WithLabelValues("bigquery").Inc()
+		return err
+	}
+
+	metrics.SinkRows.WithLabelValues("bigquery").Add(float64(len(encodedRows)))
+	return nil
 }
 
 func setupDynamicDescriptors(schema bigquery.Schema) (protoreflect.MessageDescriptor, *descriptorpb.DescriptorProto, error) {
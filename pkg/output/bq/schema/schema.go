@@ -42,6 +42,33 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "PDS",
 				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "After",
+					"type": "STRING"
+				},
+				{
+					"name": "Before",
+					"type": "STRING"
+				},
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Kind",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "IdentityHistory",
+				"type": "RECORD"
 			}
 			],
 			"name": "Actor",
@@ -84,6 +111,41 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "IndexedAt",
 				"type": "TIMESTAMP"
+			},
+			{
+				"fields": [
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ExpiresAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Neg",
+					"type": "BOOLEAN"
+				},
+				{
+					"name": "Src",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				},
+				{
+					"name": "Val",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Labels",
+				"type": "RECORD"
 			}
 			],
 			"name": "BlockedProfile",
@@ -126,6 +188,41 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "IndexedAt",
 				"type": "TIMESTAMP"
+			},
+			{
+				"fields": [
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ExpiresAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Neg",
+					"type": "BOOLEAN"
+				},
+				{
+					"name": "Src",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				},
+				{
+					"name": "Val",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Labels",
+				"type": "RECORD"
 			}
 			],
 			"name": "FollowedProfile",
@@ -209,6 +306,14 @@ func GetSchema() bigquery.Schema {
 					{
 						"name": "URI",
 						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
 					}
 					],
 					"name": "External",
@@ -258,6 +363,130 @@ func GetSchema() bigquery.Schema {
 					],
 					"name": "Record",
 					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Description",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Title",
+						"type": "STRING"
+					},
+					{
+						"name": "URI",
+						"type": "STRING"
+					}
+					],
+					"name": "EmbedRecordExternal",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "EmbedRecordVideo",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "Video",
+					"type": "RECORD"
 				}
 				],
 				"name": "Embed",
@@ -293,6 +522,84 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "URI",
 				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "ByteEnd",
+					"type": "INTEGER"
+				},
+				{
+					"name": "ByteStart",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Type",
+					"type": "STRING"
+				},
+				{
+					"name": "Value",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Facets",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "DID",
+					"type": "STRING"
+				},
+				{
+					"name": "Handle",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Mentions",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ExpiresAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Neg",
+					"type": "BOOLEAN"
+				},
+				{
+					"name": "Src",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				},
+				{
+					"name": "Val",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Labels",
+				"type": "RECORD"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "SelfLabels",
+				"type": "STRING"
 			}
 			],
 			"name": "LikedPost",
@@ -346,6 +653,14 @@ func GetSchema() bigquery.Schema {
 					{
 						"name": "URI",
 						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
 					}
 					],
 					"name": "External",
@@ -395,34 +710,303 @@ func GetSchema() bigquery.Schema {
 					],
 					"name": "Record",
 					"type": "RECORD"
-				}
-				],
-				"name": "Embed",
-				"type": "RECORD"
-			},
-			{
-				"mode": "REPEATED",
-				"name": "Langs",
-				"type": "STRING"
-			},
-			{
-				"name": "ReplyParentCID",
-				"type": "STRING"
-			},
-			{
-				"mode": "REPEATED",
-				"name": "Hashtags",
-				"type": "STRING"
-			},
-			{
-				"mode": "REPEATED",
-				"name": "URLs",
-				"type": "STRING"
-			},
-			{
-				"name": "Text",
-				"type": "STRING"
-			}
+				},
+				{
+					"fields": [
+					{
+						"name": "Description",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Title",
+						"type": "STRING"
+					},
+					{
+						"name": "URI",
+						"type": "STRING"
+					}
+					],
+					"name": "EmbedRecordExternal",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "EmbedRecordVideo",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "Video",
+					"type": "RECORD"
+				}
+				],
+				"name": "Embed",
+				"type": "RECORD"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "Langs",
+				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "AuthorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "AuthorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Text",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "QuotedPost",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "AuthorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "AuthorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Text",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "ReplyParent",
+				"type": "RECORD"
+			},
+			{
+				"name": "ReplyParentCID",
+				"type": "STRING"
+			},
+			{
+				"name": "ReplyParentURI",
+				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "AuthorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "AuthorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Text",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "ReplyRoot",
+				"type": "RECORD"
+			},
+			{
+				"name": "ReplyRootCID",
+				"type": "STRING"
+			},
+			{
+				"name": "ReplyRootURI",
+				"type": "STRING"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "Hashtags",
+				"type": "STRING"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "URLs",
+				"type": "STRING"
+			},
+			{
+				"name": "Text",
+				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "ByteEnd",
+					"type": "INTEGER"
+				},
+				{
+					"name": "ByteStart",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Type",
+					"type": "STRING"
+				},
+				{
+					"name": "Value",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Facets",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "DID",
+					"type": "STRING"
+				},
+				{
+					"name": "Handle",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Mentions",
+				"type": "RECORD"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "SelfLabels",
+				"type": "STRING"
+			}
 			],
 			"name": "Post",
 			"type": "RECORD"
@@ -436,6 +1020,11 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "DisplayName",
 				"type": "STRING"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "SelfLabels",
+				"type": "STRING"
 			}
 			],
 			"name": "Profile",
@@ -519,6 +1108,14 @@ func GetSchema() bigquery.Schema {
 					{
 						"name": "URI",
 						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
 					}
 					],
 					"name": "External",
@@ -568,29 +1165,153 @@ func GetSchema() bigquery.Schema {
 					],
 					"name": "Record",
 					"type": "RECORD"
-				}
-				],
-				"name": "Embed",
-				"type": "RECORD"
-			},
-			{
-				"mode": "REPEATED",
-				"name": "Langs",
-				"type": "STRING"
-			},
-			{
-				"name": "LikeCount",
-				"type": "INTEGER"
-			},
-			{
-				"name": "RepostCount",
-				"type": "INTEGER"
-			},
-			{
-				"mode": "REPEATED",
-				"name": "Hashtags",
-				"type": "STRING"
-			},
+				},
+				{
+					"fields": [
+					{
+						"name": "Description",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbBlobLink",
+						"type": "STRING"
+					},
+					{
+						"name": "ThumbMimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Title",
+						"type": "STRING"
+					},
+					{
+						"name": "URI",
+						"type": "STRING"
+					}
+					],
+					"name": "EmbedRecordExternal",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "EmbedRecordVideo",
+					"type": "RECORD"
+				},
+				{
+					"fields": [
+					{
+						"name": "Alt",
+						"type": "STRING"
+					},
+					{
+						"name": "BlobLink",
+						"type": "STRING"
+					},
+					{
+						"fields": [
+						{
+							"name": "BlobLink",
+							"type": "STRING"
+						},
+						{
+							"name": "Lang",
+							"type": "STRING"
+						},
+						{
+							"name": "MimeType",
+							"type": "STRING"
+						}
+						],
+						"mode": "REPEATED",
+						"name": "Captions",
+						"type": "RECORD"
+					},
+					{
+						"name": "Height",
+						"type": "INTEGER"
+					},
+					{
+						"name": "MimeType",
+						"type": "STRING"
+					},
+					{
+						"name": "Size",
+						"type": "INTEGER"
+					},
+					{
+						"name": "Width",
+						"type": "INTEGER"
+					}
+					],
+					"name": "Video",
+					"type": "RECORD"
+				}
+				],
+				"name": "Embed",
+				"type": "RECORD"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "Langs",
+				"type": "STRING"
+			},
+			{
+				"name": "LikeCount",
+				"type": "INTEGER"
+			},
+			{
+				"name": "RepostCount",
+				"type": "INTEGER"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "Hashtags",
+				"type": "STRING"
+			},
 			{
 				"mode": "REPEATED",
 				"name": "URLs",
@@ -603,10 +1324,494 @@ func GetSchema() bigquery.Schema {
 			{
 				"name": "URI",
 				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "ByteEnd",
+					"type": "INTEGER"
+				},
+				{
+					"name": "ByteStart",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Type",
+					"type": "STRING"
+				},
+				{
+					"name": "Value",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Facets",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "DID",
+					"type": "STRING"
+				},
+				{
+					"name": "Handle",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Mentions",
+				"type": "RECORD"
+			},
+			{
+				"fields": [
+				{
+					"name": "CID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ExpiresAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "Neg",
+					"type": "BOOLEAN"
+				},
+				{
+					"name": "Src",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				},
+				{
+					"name": "Val",
+					"type": "STRING"
+				}
+				],
+				"mode": "REPEATED",
+				"name": "Labels",
+				"type": "RECORD"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "SelfLabels",
+				"type": "STRING"
 			}
 			],
 			"name": "RepostedPost",
 			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "AllowIncoming",
+				"type": "STRING"
+			}
+			],
+			"name": "ChatDeclaration",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "AcceptsInteractions",
+				"type": "BOOLEAN"
+			},
+			{
+				"name": "Description",
+				"type": "STRING"
+			},
+			{
+				"name": "DID",
+				"type": "STRING"
+			},
+			{
+				"name": "DisplayName",
+				"type": "STRING"
+			}
+			],
+			"name": "FeedGenerator",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"mode": "REPEATED",
+				"name": "LabelValues",
+				"type": "STRING"
+			}
+			],
+			"name": "LabelerService",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "Description",
+				"type": "STRING"
+			},
+			{
+				"name": "Name",
+				"type": "STRING"
+			},
+			{
+				"name": "Purpose",
+				"type": "STRING"
+			}
+			],
+			"name": "List",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"fields": [
+				{
+					"name": "CreatorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "Description",
+					"type": "STRING"
+				},
+				{
+					"name": "IndexedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ListItemCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Name",
+					"type": "STRING"
+				},
+				{
+					"name": "Purpose",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "List",
+				"type": "RECORD"
+			},
+			{
+				"name": "ListURI",
+				"type": "STRING"
+			}
+			],
+			"name": "ListBlock",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"fields": [
+				{
+					"name": "CreatorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "Description",
+					"type": "STRING"
+				},
+				{
+					"name": "IndexedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ListItemCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Name",
+					"type": "STRING"
+				},
+				{
+					"name": "Purpose",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "List",
+				"type": "RECORD"
+			},
+			{
+				"name": "ListURI",
+				"type": "STRING"
+			},
+			{
+				"name": "SubjectDID",
+				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "Avatar",
+					"type": "STRING"
+				},
+				{
+					"name": "Description",
+					"type": "STRING"
+				},
+				{
+					"name": "DID",
+					"type": "STRING"
+				},
+				{
+					"name": "DisplayName",
+					"type": "STRING"
+				},
+				{
+					"name": "FollowersCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "FollowsCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Handle",
+					"type": "STRING"
+				},
+				{
+					"name": "PostsCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "IndexedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"fields": [
+					{
+						"name": "CID",
+						"type": "STRING"
+					},
+					{
+						"name": "CreatedAt",
+						"type": "TIMESTAMP"
+					},
+					{
+						"name": "ExpiresAt",
+						"type": "TIMESTAMP"
+					},
+					{
+						"name": "Neg",
+						"type": "BOOLEAN"
+					},
+					{
+						"name": "Src",
+						"type": "STRING"
+					},
+					{
+						"name": "URI",
+						"type": "STRING"
+					},
+					{
+						"name": "Val",
+						"type": "STRING"
+					}
+					],
+					"mode": "REPEATED",
+					"name": "Labels",
+					"type": "RECORD"
+				}
+				],
+				"name": "SubjectProfile",
+				"type": "RECORD"
+			}
+			],
+			"name": "ListItem",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"mode": "REPEATED",
+				"name": "DetachedEmbeddingURIs",
+				"type": "STRING"
+			},
+			{
+				"name": "DisableEmbedding",
+				"type": "BOOLEAN"
+			},
+			{
+				"name": "PostURI",
+				"type": "STRING"
+			}
+			],
+			"name": "Postgate",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "Description",
+				"type": "STRING"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "FeedURIs",
+				"type": "STRING"
+			},
+			{
+				"fields": [
+				{
+					"name": "CreatorDID",
+					"type": "STRING"
+				},
+				{
+					"name": "CreatorHandle",
+					"type": "STRING"
+				},
+				{
+					"name": "Description",
+					"type": "STRING"
+				},
+				{
+					"name": "IndexedAt",
+					"type": "TIMESTAMP"
+				},
+				{
+					"name": "ListItemCount",
+					"type": "INTEGER"
+				},
+				{
+					"name": "Name",
+					"type": "STRING"
+				},
+				{
+					"name": "Purpose",
+					"type": "STRING"
+				},
+				{
+					"name": "URI",
+					"type": "STRING"
+				}
+				],
+				"name": "List",
+				"type": "RECORD"
+			},
+			{
+				"name": "ListURI",
+				"type": "STRING"
+			},
+			{
+				"name": "Name",
+				"type": "STRING"
+			}
+			],
+			"name": "Starterpack",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "AllowFollowing",
+				"type": "BOOLEAN"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "AllowListURIs",
+				"type": "STRING"
+			},
+			{
+				"name": "AllowMentioned",
+				"type": "BOOLEAN"
+			},
+			{
+				"mode": "REPEATED",
+				"name": "HiddenReplies",
+				"type": "STRING"
+			},
+			{
+				"name": "PostURI",
+				"type": "STRING"
+			}
+			],
+			"name": "Threadgate",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "CID",
+				"type": "STRING"
+			},
+			{
+				"name": "CreatedAt",
+				"type": "TIMESTAMP"
+			},
+			{
+				"name": "ExpiresAt",
+				"type": "TIMESTAMP"
+			},
+			{
+				"name": "Neg",
+				"type": "BOOLEAN"
+			},
+			{
+				"name": "Src",
+				"type": "STRING"
+			},
+			{
+				"name": "URI",
+				"type": "STRING"
+			},
+			{
+				"name": "Val",
+				"type": "STRING"
+			}
+			],
+			"name": "Label",
+			"type": "RECORD"
+		},
+		{
+			"fields": [
+			{
+				"name": "After",
+				"type": "STRING"
+			},
+			{
+				"name": "Before",
+				"type": "STRING"
+			},
+			{
+				"name": "CID",
+				"type": "STRING"
+			},
+			{
+				"name": "CreatedAt",
+				"type": "TIMESTAMP"
+			},
+			{
+				"name": "Kind",
+				"type": "STRING"
+			}
+			],
+			"name": "IdentityChange",
+			"type": "RECORD"
 		}
 		],
 		"name": "Projection",
@@ -623,6 +1828,14 @@ func GetSchema() bigquery.Schema {
 	{
 		"name": "Type",
 		"type": "STRING"
+	},
+	{
+		"name": "URI",
+		"type": "STRING"
+	},
+	{
+		"name": "Verified",
+		"type": "STRING"
 	}
   ]`
 
@@ -0,0 +1,80 @@
+// Package buffer gathers rows on their way to a sink that writes them in bulk
+// (e.g., BigQuery). Rows are flushed once enough of them have built up, or once
+// the oldest has waited long enough, so that rows at the end of a burst (e.g., a
+// lease's last few) don't sit unwritten until more arrive.
+package buffer
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+)
+
+type Buffer struct {
+	Size     int           // Rows to flush at once
+	MaxDelay time.Duration // Longest a row waits to be flushed (0 for as long as it takes to fill up)
+
+	// Flush writes rows. If it fails, they're kept and tried again at the next
+	// flush.
+	Flush func(ctx context.Context, rows []map[string]interface{}) error
+
+	// Acknowledge, if set, is told whether each row was written, in order
+	Acknowledge func(written bool)
+}
+
+// Run buffers rows from the channel until it's closed (flushing whatever is
+// left) or the context is cancelled.
+func (b Buffer) Run(ctx context.Context, rows <-chan map[string]interface{}) error {
+	var buffer []map[string]interface{}
+	var deadline <-chan time.Time
+
+	flush := func() error {
+		if len(buffer) == 0 {
+			return nil
+		}
+		if err := b.Flush(ctx, buffer); err != nil {
+			return err
+		}
+		if b.Acknowledge != nil {
+			for range buffer {
+				b.Acknowledge(true)
+			}
+		}
+		buffer = nil
+		deadline = nil
+		return nil
+	}
+
+	for {
+		select {
+		case row, ok := <-rows:
+			if !ok {
+				// Flush whatever is left before we go
+				return flush()
+			}
+			buffer = append(buffer, row)
+			metrics.Progress()
+			if len(buffer) == 1 && b.MaxDelay > 0 {
+				deadline = time.After(b.MaxDelay)
+			}
+			if len(buffer) < b.Size {
+				continue
+			}
+
+		case <-deadline:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err := flush(); err != nil {
+			log.Errorf("Failed to flush buffer: %v", err)
+			// Try again once the buffer grows, or has waited another while
+			if b.MaxDelay > 0 {
+				deadline = time.After(b.MaxDelay)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a BloomSet is saved (and also when it's closed). Keys added since
+// the last save are forgotten if we go down, which lets duplicates through but
+// never drops rows.
+const bloomSaveInterval = 30 * time.Second
+
+// BloomSet remembers keys in a pair of bloom filters, each holding up to half
+// of MaxSize. Once the current one is full, the older one is cleared and takes
+// over, so the oldest keys are forgotten.
+type BloomSet struct {
+	Path    string
+	MaxSize int
+
+	lk       sync.Mutex
+	hashes   uint64
+	current  *bloom
+	previous *bloom
+	dirty    bool
+	done     chan struct{}
+}
+
+type bloom struct {
+	bits  []uint64
+	count uint64
+}
+
+func OpenBloomSet(path string, maxSize int, falsePositiveRate float64) (*BloomSet, error) {
+	capacity := float64(max(maxSize/2, 1))
+	// The usual sizing, for the given rate at capacity
+	numBits := uint64(math.Ceil(-capacity * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	numWords := (numBits + 63) / 64
+	hashes := uint64(math.Max(1, math.Round(float64(numWords*64)/capacity*math.Ln2)))
+
+	s := BloomSet{
+		Path:     path,
+		MaxSize:  maxSize,
+		hashes:   hashes,
+		current:  &bloom{bits: make([]uint64, numWords)},
+		previous: &bloom{bits: make([]uint64, numWords)},
+		done:     make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("failed to load dedup bloom filter from %s: %+v", path, err)
+	}
+
+	go s.saveContinuously()
+
+	return &s, nil
+}
+
+// The bits a key sets, by double hashing
+func (s *BloomSet) positions(key []byte, numBits uint64) []uint64 {
+	h1 := binary.BigEndian.Uint64(key[:8])
+	h2 := binary.BigEndian.Uint64(key[8:16]) | 1
+	positions := make([]uint64, s.hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % numBits
+	}
+	return positions
+}
+
+func (b *bloom) has(positions []uint64) bool {
+	for _, p := range positions {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BloomSet) Contains(key []byte) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	positions := s.positions(key, uint64(len(s.current.bits))*64)
+	return s.current.has(positions) || s.previous.has(positions), nil
+}
+
+func (s *BloomSet) Add(key []byte) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.current.count >= uint64(max(s.MaxSize/2, 1)) {
+		s.previous, s.current = s.current, s.previous
+		clear(s.current.bits)
+		s.current.count = 0
+	}
+
+	for _, p := range s.positions(key, uint64(len(s.current.bits))*64) {
+		s.current.bits[p/64] |= 1 << (p % 64)
+	}
+	s.current.count++
+	s.dirty = true
+	return nil
+}
+
+func (s *BloomSet) Close() error {
+	close(s.done)
+	return s.save()
+}
+
+func (s *BloomSet) saveContinuously() {
+	for {
+		select {
+		case <-time.After(bloomSaveInterval):
+		case <-s.done:
+			return
+		}
+
+		if err := s.save(); err != nil {
+			log.Errorf("Failed to save dedup bloom filter to %s: %+v", s.Path, err)
+		}
+	}
+}
+
+// The file is the number of words in each filter and the number of hashes,
+// then each filter's count and words (current first). Filters of another size
+// (i.e., saved with another MaxSize) are ignored.
+func (s *BloomSet) save() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	// Write to the side and rename, so that a crash doesn't leave half a file
+	tmpPath := s.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	words := []uint64{uint64(len(s.current.bits)), s.hashes, s.current.count}
+	words = append(words, s.current.bits...)
+	words = append(words, s.previous.count)
+	words = append(words, s.previous.bits...)
+	if err := binary.Write(w, binary.BigEndian, words); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.Path); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+func (s *BloomSet) load() error {
+	f, err := os.Open(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var header [2]uint64
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header[0] != uint64(len(s.current.bits)) || header[1] != s.hashes {
+		log.Warnf("Dedup bloom filter at %s was saved with a different size, so starting afresh", s.Path)
+		return nil
+	}
+
+	for _, b := range []*bloom{s.current, s.previous} {
+		if err := binary.Read(r, binary.BigEndian, &b.count); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, b.bits); err != nil {
+			return err
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return errors.New("unexpected data at the end of the file")
+	}
+	return nil
+}
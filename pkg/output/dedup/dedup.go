@@ -0,0 +1,189 @@
+package dedup
+
+// Deduplication of output rows, so that restarting the stream from a backfill
+// cursor (or re-running a pull) doesn't write the same rows twice. Each row has
+// a key: its seq, URI and action for firehose rows (i.e., the op within the
+// commit), or its URI and record CID for rows from repos. Keys are remembered
+// in a Set once the sink has written their rows, and rows whose keys are
+// already there are dropped.
+//
+// Keys are only remembered once their rows have actually been written (sinks
+// acknowledge them, in order), so that rows that were still buffered when we
+// went down are written again rather than dropped as duplicates. Rows without a
+// key always go through. Acknowledgements are passed on upstream, in the order
+// the filter was given the rows, with dropped rows counting as written.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSize = 10_000_000 // Keys remembered
+
+	// How likely a bloom filter is to take a new row for a duplicate
+	BloomFalsePositiveRate = 1e-6
+)
+
+// Set is where the keys of written rows are remembered. Sets are bounded, so
+// they forget the oldest keys once they're full.
+type Set interface {
+	Contains(key []byte) (bool, error)
+	Add(key []byte) error
+	Close() error
+}
+
+// Open opens a set of the given kind: "set" (exact, in a directory on disk) or
+// "bloom" (a rotating bloom filter, saved to a file).
+func Open(kind string, path string, size int) (Set, error) {
+	switch kind {
+	case "set":
+		return OpenDiskSet(path, size)
+	case "bloom":
+		return OpenBloomSet(path, size, BloomFalsePositiveRate)
+	default:
+		return nil, fmt.Errorf("unknown dedup kind %q (expected none, set or bloom)", kind)
+	}
+}
+
+// Key is what a row is deduplicated by ("" if it doesn't have one). Rows with a
+// seq are from the firehose, where the seq, URI and action pick out the op;
+// otherwise, the URI and the record's CID (see Hydrator.SetCID) pick out the
+// version of the record.
+func Key(row map[string]interface{}) string {
+	uri, _ := row["URI"].(string)
+	if uri == "" {
+		return ""
+	}
+	action, _ := row["Action"].(string)
+
+	if seq, ok := row["Seq"]; ok {
+		return fmt.Sprintf("seq|%v|%s|%s", seq, uri, action)
+	}
+	if full, ok := row["Full"].(map[string]interface{}); ok {
+		if cid, ok := full["_CID"].(string); ok && cid != "" {
+			return fmt.Sprintf("cid|%s|%s|%s", uri, cid, action)
+		}
+	}
+	return ""
+}
+
+func hashKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:16]
+}
+
+// Filter sits between a command and its sink, dropping rows that were already
+// written.
+type Filter struct {
+	// Upstream, if set, is told whether each row the filter was given was
+	// written, in order
+	Upstream func(written bool)
+
+	lk       sync.Mutex
+	seen     Set
+	pending  map[string]int // Keys of rows handed to the sink but not yet written, and how many
+	inFlight []inFlightRow  // Rows given to the filter but not yet acknowledged, oldest first
+	closed   bool
+}
+
+type inFlightRow struct {
+	key     string // "" for rows without one
+	dropped bool   // Whether it was a duplicate (so won't be acknowledged by the sink)
+}
+
+func NewFilter(seen Set) *Filter {
+	return &Filter{seen: seen, pending: make(map[string]int)}
+}
+
+// Admit reports whether a row should be written, i.e., it isn't a duplicate of
+// one that was written (or is on its way to being written). Admitted rows must
+// be acknowledged by the sink, in order.
+func (f *Filter) Admit(row map[string]interface{}) bool {
+	key := Key(row)
+
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if f.closed || key == "" {
+		f.inFlight = append(f.inFlight, inFlightRow{})
+		return true
+	}
+
+	duplicate := f.pending[key] > 0
+	if !duplicate {
+		seen, err := f.seen.Contains(hashKey(key))
+		if err != nil {
+			// Better a duplicate than a lost row
+			log.Errorf("Failed to look up dedup key %s: %+v", key, err)
+		}
+		duplicate = seen
+	}
+	if duplicate {
+		// Nothing ahead of it to wait for, so it's as good as written
+		if len(f.inFlight) == 0 {
+			f.upstream(true)
+		} else {
+			f.inFlight = append(f.inFlight, inFlightRow{key: key, dropped: true})
+		}
+		return false
+	}
+
+	f.pending[key]++
+	f.inFlight = append(f.inFlight, inFlightRow{key: key})
+	return true
+}
+
+// Acknowledge is called by the sink for each admitted row, in order, once it
+// has been written (or has failed to be, in which case it isn't remembered, so
+// that it can be written again).
+func (f *Filter) Acknowledge(written bool) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if len(f.inFlight) == 0 {
+		log.Errorf("Sink acknowledged more rows than it was given")
+		return
+	}
+	key := f.inFlight[0].key
+	f.inFlight = f.inFlight[1:]
+
+	if key != "" {
+		if f.pending[key]--; f.pending[key] <= 0 {
+			delete(f.pending, key)
+		}
+		if written && !f.closed {
+			if err := f.seen.Add(hashKey(key)); err != nil {
+				log.Errorf("Failed to remember dedup key %s: %+v", key, err)
+			}
+		}
+	}
+	f.upstream(written)
+
+	// Duplicates dropped after it were waiting on it
+	for len(f.inFlight) > 0 && f.inFlight[0].dropped {
+		f.inFlight = f.inFlight[1:]
+		f.upstream(true)
+	}
+}
+
+// Called with f.lk held, so that acknowledgements go upstream in order
+func (f *Filter) upstream(written bool) {
+	if f.Upstream != nil {
+		f.Upstream(written)
+	}
+}
+
+func (f *Filter) Close() error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.seen.Close()
+}
@@ -0,0 +1,107 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// DiskSet is an exact set of keys on disk, which forgets the oldest keys once
+// it holds more than MaxSize. Each key is stored twice: under "k", pointing at
+// when it was added, and under "o" in the order it was added, so that the
+// oldest can be found.
+type DiskSet struct {
+	DB      *pebble.DB
+	MaxSize int
+
+	lk         sync.Mutex
+	head, tail uint64 // The oldest key's position, and the position after the newest
+}
+
+var (
+	keyPrefix   = []byte("k")
+	orderPrefix = []byte("o")
+	boundsKey   = []byte("b")
+)
+
+func OpenDiskSet(path string, maxSize int) (*DiskSet, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup set at %s: %+v", path, err)
+	}
+
+	s := DiskSet{DB: db, MaxSize: maxSize}
+
+	raw, closer, err := db.Get(boundsKey)
+	if err == nil {
+		if len(raw) == 16 {
+			s.head = binary.BigEndian.Uint64(raw[:8])
+			s.tail = binary.BigEndian.Uint64(raw[8:])
+		}
+		closer.Close()
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		db.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func prefixed(prefix []byte, rest []byte) []byte {
+	return append(append([]byte{}, prefix...), rest...)
+}
+
+func position(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func (s *DiskSet) Contains(key []byte) (bool, error) {
+	_, closer, err := s.DB.Get(prefixed(keyPrefix, key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func (s *DiskSet) Add(key []byte) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	batch := s.DB.NewBatch()
+	batch.Set(prefixed(keyPrefix, key), position(s.tail), nil)
+	batch.Set(prefixed(orderPrefix, position(s.tail)), key, nil)
+	s.tail++
+
+	// Forget the oldest keys, unless they've been added again since
+	for s.MaxSize > 0 && s.tail-s.head > uint64(s.MaxSize) {
+		oldestKey := prefixed(orderPrefix, position(s.head))
+		oldest, closer, err := s.DB.Get(oldestKey)
+		if err == nil {
+			at, closer2, err := s.DB.Get(prefixed(keyPrefix, oldest))
+			if err == nil {
+				if binary.BigEndian.Uint64(at) == s.head && !bytes.Equal(oldest, key) {
+					batch.Delete(prefixed(keyPrefix, oldest), nil)
+				}
+				closer2.Close()
+			}
+			closer.Close()
+		}
+		batch.Delete(oldestKey, nil)
+		s.head++
+	}
+
+	batch.Set(boundsKey, append(position(s.head), position(s.tail)...), nil)
+	return batch.Commit(pebble.NoSync)
+}
+
+func (s *DiskSet) Close() error {
+	return s.DB.Close()
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+	"github.com/stanfordio/skyfall/pkg/shard"
 	"github.com/stanfordio/skyfall/pkg/utils"
 )
 
@@ -15,9 +19,14 @@ type Outfile struct {
 	OutputFilePath string
 	StringifyFull  bool
 	OutputChannel  chan map[string]interface{}
+
+	// Acknowledge, if set, is told whether each row was written, in order
+	Acknowledge func(written bool)
 }
 
-func (outfile Outfile) GetBackfillSeqno() (int64, error) {
+// GetBackfillSeqno is the seq of the file's last line. Files are per shard, so
+// when sharding, the last line had better be from this shard.
+func (outfile Outfile) GetBackfillSeqno(s shard.Shard) (int64, error) {
 	lastLine, err := utils.GetLastLine(outfile.OutputFilePath)
 	if err != nil {
 		log.Warnf("Unable to read last line of output file for backfill: %+v", err)
@@ -30,6 +39,10 @@ func (outfile Outfile) GetBackfillSeqno() (int64, error) {
 	if err != nil {
 		return 0, errors.New("unable to parse last line as JSON")
 	}
+	if did, ok := actorDID(lastData); ok && !s.Owns(did) {
+		return 0, fmt.Errorf("last line of output file is from another shard than %s; give each shard its own output file", s)
+	}
+
 	lastSeqFloat := lastData["Seq"]
 	if lastSeqFloat == nil {
 		return 0, errors.New("unable to find seq in last line of output file")
@@ -39,6 +52,13 @@ func (outfile Outfile) GetBackfillSeqno() (int64, error) {
 	}
 }
 
+func actorDID(row map[string]interface{}) (string, bool) {
+	projection, _ := row["Projection"].(map[string]interface{})
+	actor, _ := projection["Actor"].(map[string]interface{})
+	did, ok := actor["DID"].(string)
+	return did, ok
+}
+
 func (outfile Outfile) Setup() error {
 	if outfile.OutputFilePath == "" {
 		return errors.New("output file path is required")
@@ -46,6 +66,10 @@ func (outfile Outfile) Setup() error {
 	return nil
 }
 
+func (outfile Outfile) Close() error {
+	return nil
+}
+
 func (outfile Outfile) StreamOutput(ctx context.Context) error {
 	f, err := os.OpenFile(outfile.OutputFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
@@ -54,10 +78,18 @@ func (outfile Outfile) StreamOutput(ctx context.Context) error {
 	}
 	defer f.Close()
 
+	metrics.SetReady("output", true)
+	defer metrics.SetReady("output", false)
+
 	_, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	for {
-		e := <-outfile.OutputChannel
+		e, ok := <-outfile.OutputChannel
+		if !ok {
+			log.Info("Output channel closed, exiting.")
+			return nil
+		}
 
 		if outfile.StringifyFull {
 			// Set "full" to the JSON representation of "full"
@@ -75,9 +107,23 @@ func (outfile Outfile) StreamOutput(ctx context.Context) error {
 			log.Errorf("Failed to marshal event: %+v", err)
 			cancel()
 		}
+		start := time.Now()
 		if _, err := f.Write(append(marshaled, byte('\n'))); err != nil {
 			log.Errorf("Failed to write output: %+v", err)
+			metrics.SinkErrors.WithLabelValues("file").Inc()
 			cancel()
+			outfile.acknowledge(false)
+		} else {
+			metrics.SinkRows.WithLabelValues("file").Inc()
+			outfile.acknowledge(true)
 		}
+		metrics.SinkFlushLatency.WithLabelValues("file").Observe(time.Since(start).Seconds())
+		metrics.Progress()
+	}
+}
+
+func (outfile Outfile) acknowledge(written bool) {
+	if outfile.Acknowledge != nil {
+		outfile.Acknowledge(written)
 	}
 }
@@ -3,8 +3,11 @@ package output
 import (
 	"context"
 
+	"github.com/stanfordio/skyfall/pkg/metrics"
 	"github.com/stanfordio/skyfall/pkg/output/bq"
+	"github.com/stanfordio/skyfall/pkg/output/dedup"
 	"github.com/stanfordio/skyfall/pkg/output/outfile"
+	"github.com/stanfordio/skyfall/pkg/shard"
 	"github.com/urfave/cli/v2"
 
 	log "github.com/sirupsen/logrus"
@@ -12,29 +15,125 @@ import (
 
 type Output interface {
 	Setup() error
-	GetBackfillSeqno() (int64, error)
+	GetBackfillSeqno(shard.Shard) (int64, error) // The last seq written for the shard
 	StreamOutput(context.Context) error
+	Close() error // Releases what the output holds (e.g., its dedup state)
 }
 
 func NewOutput(cctx *cli.Context, outputChannel chan map[string]interface{}) (Output, error) {
+	return newOutput(cctx, outputChannel, nil)
+}
+
+// NewTrackedOutput is NewOutput for rows sent through a Tracker, which the sink
+// acknowledges so that the tracker knows when its batches have been written.
+func NewTrackedOutput(cctx *cli.Context, tracker *Tracker) (Output, error) {
+	return newOutput(cctx, tracker.Channel, tracker.Acknowledge)
+}
+
+// acknowledge, if set, is told whether each row sent to outputChannel was
+// written, in order.
+func newOutput(cctx *cli.Context, outputChannel chan map[string]interface{}, acknowledge func(written bool)) (Output, error) {
+	metrics.WatchOutputChannel(outputChannel)
+
 	if cctx.String("output-bq-table") != "" {
 		log.Infof("output-bq-table specified, so writing output to BigQuery table: %s", cctx.String("output-bq-table"))
-		bq, err := bq.New(cctx.Context, cctx.String("output-bq-table"), outputChannel)
+		filter, sinkChannel, err := newDedupFilter(cctx, cctx.String("output-bq-table"), outputChannel)
+		if err != nil {
+			return nil, err
+		}
+		bq, err := bq.New(cctx.Context, cctx.String("output-bq-table"), sinkChannel)
 		if err != nil {
 			log.Fatalf("Failed to create BigQuery output: %+v", err)
 			return nil, err
 		}
-		return bq, nil
+		if filter == nil {
+			bq.Acknowledge = acknowledge
+			return bq, nil
+		}
+		filter.Upstream = acknowledge
+		bq.Acknowledge = filter.Acknowledge
+		return newDedupOutput(bq, "bigquery", filter, outputChannel, sinkChannel), nil
 	}
 
 	if cctx.String("output-file") != "" {
 		log.Infof("output-file specified, so writing output to file: %s", cctx.String("output-file"))
-		return outfile.Outfile{
+		filter, sinkChannel, err := newDedupFilter(cctx, cctx.String("output-file"), outputChannel)
+		if err != nil {
+			return nil, err
+		}
+		outfile := outfile.Outfile{
 			OutputFilePath: cctx.String("output-file"),
-			OutputChannel:  outputChannel,
+			OutputChannel:  sinkChannel,
 			StringifyFull:  cctx.Bool("stringify-full"),
-		}, nil
+		}
+		if filter == nil {
+			outfile.Acknowledge = acknowledge
+			return outfile, nil
+		}
+		filter.Upstream = acknowledge
+		outfile.Acknowledge = filter.Acknowledge
+		return newDedupOutput(outfile, "file", filter, outputChannel, sinkChannel), nil
 	}
 
 	return nil, nil
 }
+
+// newDedupFilter opens the dedup filter the command asked for, if any, and
+// makes the channel between it and the sink. The state goes next to the
+// output (e.g., <output-file>.dedup), unless given.
+func newDedupFilter(cctx *cli.Context, outputName string, outputChannel chan map[string]interface{}) (*dedup.Filter, chan map[string]interface{}, error) {
+	kind := cctx.String("dedup")
+	if kind == "" || kind == "none" {
+		return nil, outputChannel, nil
+	}
+
+	statePath := cctx.String("dedup-state")
+	if statePath == "" {
+		statePath = outputName + ".dedup"
+	}
+	log.Infof("Deduplicating output (%s of up to %d keys, at %s)", kind, cctx.Int("dedup-size"), statePath)
+
+	seen, err := dedup.Open(kind, statePath, cctx.Int("dedup-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dedup.NewFilter(seen), make(chan map[string]interface{}, cap(outputChannel)), nil
+}
+
+// dedupOutput drops duplicate rows on their way from the command to the sink.
+type dedupOutput struct {
+	Output
+	sink   string
+	filter *dedup.Filter
+	in     chan map[string]interface{}
+	out    chan map[string]interface{}
+}
+
+func newDedupOutput(sink Output, name string, filter *dedup.Filter, in chan map[string]interface{}, out chan map[string]interface{}) *dedupOutput {
+	return &dedupOutput{Output: sink, sink: name, filter: filter, in: in, out: out}
+}
+
+func (d *dedupOutput) StreamOutput(ctx context.Context) error {
+	go func() {
+		for row := range d.in {
+			if !d.filter.Admit(row) {
+				metrics.DedupRows.WithLabelValues(d.sink, "duplicate").Inc()
+				continue
+			}
+			metrics.DedupRows.WithLabelValues(d.sink, "unique").Inc()
+			d.out <- row
+		}
+		close(d.out)
+	}()
+
+	return d.Output.StreamOutput(ctx)
+}
+
+// Close saves the dedup state. Rows written from here on aren't remembered, so
+// may be written again next time.
+func (d *dedupOutput) Close() error {
+	if err := d.filter.Close(); err != nil {
+		log.Errorf("Failed to close dedup state: %+v", err)
+	}
+	return d.Output.Close()
+}
@@ -0,0 +1,91 @@
+package output
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tracker follows rows from a command to its sink, so that the command can tell
+// when a batch of rows (e.g., a CAR's) has actually been written, rather than
+// just handed to the output. Rows are queued in the order they're sent to the
+// channel, and the sink acknowledges them in that order (see NewTrackedOutput).
+// Every row sent to the channel has to go through the tracker.
+type Tracker struct {
+	Channel chan map[string]interface{}
+
+	sendLk sync.Mutex // Held while sending, so that the queue is in the channel's order
+	lk     sync.Mutex
+	queue  []*Batch // The batch of each row sent but not yet acknowledged, oldest first
+}
+
+func NewTracker(channel chan map[string]interface{}) *Tracker {
+	return &Tracker{Channel: channel}
+}
+
+// Batch is a group of rows whose writing is reported together.
+type Batch struct {
+	tracker *Tracker
+	pending int  // Rows sent but not yet acknowledged
+	failed  bool // Whether any row failed to be written
+	closed  bool
+	onDone  func(written bool)
+}
+
+func (t *Tracker) NewBatch() *Batch {
+	return &Batch{tracker: t}
+}
+
+// Send sends a row to the output as part of the batch.
+func (b *Batch) Send(row map[string]interface{}) {
+	t := b.tracker
+	t.sendLk.Lock()
+	defer t.sendLk.Unlock()
+
+	t.lk.Lock()
+	b.pending++
+	t.queue = append(t.queue, b)
+	t.lk.Unlock()
+
+	t.Channel <- row
+}
+
+// Close ends the batch. Once every row in it has been acknowledged (right away,
+// if they already have been), onDone is told whether they were all written.
+// It's called from the sink, so it shouldn't hold it up for long.
+func (b *Batch) Close(onDone func(written bool)) {
+	t := b.tracker
+	t.lk.Lock()
+	b.closed = true
+	b.onDone = onDone
+	done := b.pending == 0
+	t.lk.Unlock()
+
+	if done {
+		onDone(!b.failed)
+	}
+}
+
+// Acknowledge is called by the sink for each row, in order, once it has been
+// written (or has failed to be).
+func (t *Tracker) Acknowledge(written bool) {
+	t.lk.Lock()
+	if len(t.queue) == 0 {
+		t.lk.Unlock()
+		log.Errorf("Sink acknowledged more rows than were sent")
+		return
+	}
+	b := t.queue[0]
+	t.queue[0] = nil
+	t.queue = t.queue[1:]
+	b.pending--
+	if !written {
+		b.failed = true
+	}
+	done := b.closed && b.pending == 0
+	t.lk.Unlock()
+
+	if done {
+		b.onDone(!b.failed)
+	}
+}
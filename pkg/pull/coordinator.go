@@ -0,0 +1,437 @@
+package pull
+
+// Distributed pulls. A coordinator splits the census into ranges and leases
+// them out over HTTP to workers (on any number of machines), which pull the
+// DIDs in each range and report back. Workers heartbeat while they work, and a
+// lease that isn't renewed in time expires, so that its range goes to another
+// worker. Finished ranges are saved to the intermediate state, so that a
+// restarted coordinator picks up where it left off.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/census"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+)
+
+const (
+	DefaultLeaseSize = 1000 // DIDs per lease
+	DefaultLeaseTTL  = 2 * time.Minute
+)
+
+// Lease is a range of the census that a worker has claimed.
+type Lease struct {
+	ID    string        `json:"id"`
+	Start uint64        `json:"start"` // Census file indices (1-indexed) of the range, [Start, End)
+	End   uint64        `json:"end"`
+	DIDs  []string      `json:"dids"`
+	TTL   time.Duration `json:"ttl"` // How long the lease lasts without a heartbeat
+}
+
+type leaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+type heartbeatRequest struct {
+	ID string `json:"id"`
+}
+
+type reportRequest struct {
+	ID     string   `json:"id"`
+	Done   int      `json:"done"`
+	Failed []string `json:"failed"` // DIDs that couldn't be pulled
+}
+
+// Shared with single-process pulls (see intermediateState), so that either can
+// pick up from the other
+type coordinatorState struct {
+	FirstUnpulledDidIndex uint64      // All DIDs up to this one have been pulled, 1-indexed
+	Finished              [][2]uint64 // Ranges ([start, end) census file indices) that have been pulled
+	Retry                 []uint64    // DIDs that a single-process pull left to pull again
+}
+
+type censusRange struct {
+	start, end uint64
+	offset     int64 // Of the start's line in the census file
+
+	lease   string // ID of the lease on the range, if any
+	worker  string
+	expires time.Time
+	done    bool
+}
+
+type Coordinator struct {
+	CensusPath            string
+	IntermediateStatePath string
+	LeaseSize             int
+	LeaseTTL              time.Duration
+
+	lk        sync.Mutex
+	ranges    []*censusRange
+	leases    map[string]*censusRange // By ID
+	remaining int                     // Ranges that aren't done
+	finished  [][2]uint64             // Sorted and merged
+	allDone   chan struct{}
+}
+
+// Serve leases out the census on the given address until every range has been
+// pulled (or the context is cancelled).
+func (c *Coordinator) Serve(ctx context.Context, addr string) error {
+	if err := c.loadState(); err != nil {
+		log.Errorf("Failed to load intermediate state from disk: %v", err)
+		return err
+	}
+	if err := c.splitCensus(); err != nil {
+		log.Errorf("Failed to split census file: %v", err)
+		return err
+	}
+	c.leases = make(map[string]*censusRange)
+	c.allDone = make(chan struct{})
+	c.updateMetrics()
+
+	if c.remaining == 0 {
+		log.Infof("Every DID in %s has already been pulled", c.CensusPath)
+		return nil
+	}
+	log.Infof("Leasing %d ranges of %s to workers", c.remaining, c.CensusPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /lease", c.handleLease)
+	mux.HandleFunc("POST /heartbeat", c.handleHeartbeat)
+	mux.HandleFunc("POST /report", c.handleReport)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Infof("Serving leases on %s", addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-c.allDone:
+		// Stay up for a while, so that workers waiting on leases are told
+		// there are none left rather than finding the coordinator gone
+		log.Infof("Every range has been pulled; shutting down in %s", c.LeaseTTL)
+		select {
+		case <-time.After(c.LeaseTTL):
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	case err := <-serveErr:
+		return err
+	}
+
+	return server.Shutdown(context.Background())
+}
+
+// splitCensus splits the DIDs that haven't been pulled into ranges of up to
+// LeaseSize.
+func (c *Coordinator) splitCensus() error {
+	file, err := os.Open(c.CensusPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var current *censusRange
+	var offset int64
+	var unpulled int
+	finished := c.finished
+	for index := uint64(1); ; index++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+
+		for len(finished) > 0 && finished[0][1] <= index {
+			finished = finished[1:]
+		}
+		if len(finished) > 0 && finished[0][0] <= index {
+			current = nil
+			continue
+		}
+
+		unpulled++
+		if current == nil || current.end-current.start >= uint64(c.LeaseSize) {
+			current = &censusRange{start: index, end: index, offset: lineOffset}
+			c.ranges = append(c.ranges, current)
+			c.remaining++
+		}
+		current.end = index + 1
+	}
+
+	metrics.PullDIDsRemaining.Set(float64(unpulled))
+	return nil
+}
+
+// dids reads the DIDs in a range from the census file.
+func (c *Coordinator) dids(r *censusRange) ([]string, error) {
+	file, err := os.Open(c.CensusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	dids := make([]string, 0, r.end-r.start)
+	scanner := bufio.NewScanner(file)
+	for uint64(len(dids)) < r.end-r.start && scanner.Scan() {
+		var repoInfo census.CensusFileEntry
+		if err := json.Unmarshal(scanner.Bytes(), &repoInfo); err != nil {
+			return nil, fmt.Errorf("failed to decode census file line %d: %w", r.start+uint64(len(dids)), err)
+		}
+		dids = append(dids, repoInfo.Did)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if uint64(len(dids)) < r.end-r.start {
+		return nil, errors.New("census file changed since the coordinator started")
+	}
+	return dids, nil
+}
+
+func (c *Coordinator) handleLease(w http.ResponseWriter, req *http.Request) {
+	var body leaseRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lk.Lock()
+	c.reclaimExpired()
+	if c.remaining == 0 {
+		c.lk.Unlock()
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	var r *censusRange
+	for _, candidate := range c.ranges {
+		if !candidate.done && candidate.lease == "" {
+			r = candidate
+			break
+		}
+	}
+	if r == nil {
+		// Everything left is leased, but leases may yet expire
+		c.lk.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	r.lease = newLeaseID()
+	r.worker = body.Worker
+	r.expires = time.Now().Add(c.LeaseTTL)
+	c.leases[r.lease] = r
+	lease := Lease{ID: r.lease, Start: r.start, End: r.end, TTL: c.LeaseTTL}
+	c.updateMetrics()
+	c.lk.Unlock()
+
+	dids, err := c.dids(r)
+	if err != nil {
+		log.Errorf("Failed to read DIDs %d-%d from census file: %v", r.start, r.end-1, err)
+		c.release(lease.ID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lease.DIDs = dids
+
+	log.Infof("Leased DIDs %d-%d to %s", lease.Start, lease.End-1, body.Worker)
+	writeJSON(w, lease)
+}
+
+func (c *Coordinator) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
+	var body heartbeatRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.reclaimExpired()
+	r, ok := c.leases[body.ID]
+	if !ok {
+		http.Error(w, "lease expired", http.StatusGone)
+		return
+	}
+	r.expires = time.Now().Add(c.LeaseTTL)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Coordinator) handleReport(w http.ResponseWriter, req *http.Request) {
+	var body reportRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	// A lease that expired may have gone to someone else by now, so its range
+	// is theirs to report
+	r, ok := c.leases[body.ID]
+	if !ok {
+		http.Error(w, "lease expired", http.StatusConflict)
+		return
+	}
+
+	for _, did := range body.Failed {
+		log.Warnf("%s failed to pull %s", r.worker, did)
+	}
+	log.Infof("%s pulled DIDs %d-%d (%d done, %d failed)", r.worker, r.start, r.end-1, body.Done, len(body.Failed))
+	metrics.PullDIDs.WithLabelValues("done").Add(float64(body.Done))
+	metrics.PullDIDs.WithLabelValues("failed").Add(float64(len(body.Failed)))
+	metrics.PullDIDsRemaining.Sub(float64(r.end - r.start))
+
+	delete(c.leases, body.ID)
+	r.lease = ""
+	r.done = true
+	c.remaining--
+	c.addFinished(r.start, r.end)
+	c.updateMetrics()
+
+	if err := c.saveState(); err != nil {
+		log.Fatalf("Failed to save intermediate state to disk: %v", err)
+	}
+	if c.remaining == 0 {
+		close(c.allDone)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// release gives up a lease (e.g., because it couldn't be served).
+func (c *Coordinator) release(id string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if r, ok := c.leases[id]; ok {
+		delete(c.leases, id)
+		r.lease = ""
+		c.updateMetrics()
+	}
+}
+
+// reclaimExpired frees up ranges whose leases have expired, so that they can
+// be leased to someone else. Callers must hold c.lk.
+func (c *Coordinator) reclaimExpired() {
+	now := time.Now()
+	for id, r := range c.leases {
+		if r.expires.Before(now) {
+			log.Warnf("Lease on DIDs %d-%d held by %s expired, so it's up for grabs again", r.start, r.end-1, r.worker)
+			delete(c.leases, id)
+			r.lease = ""
+			metrics.PullLeasesExpired.Inc()
+		}
+	}
+	c.updateMetrics()
+}
+
+// Callers must hold c.lk.
+func (c *Coordinator) updateMetrics() {
+	metrics.PullLeases.WithLabelValues("available").Set(float64(c.remaining - len(c.leases)))
+	metrics.PullLeases.WithLabelValues("leased").Set(float64(len(c.leases)))
+	metrics.PullLeases.WithLabelValues("done").Set(float64(len(c.ranges) - c.remaining))
+}
+
+// addFinished adds a range to the finished ranges, merging it with its
+// neighbours. Callers must hold c.lk (or be the only user of c).
+func (c *Coordinator) addFinished(start uint64, end uint64) {
+	finished := append(c.finished, [2]uint64{start, end})
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i][0] < finished[j][0]
+	})
+
+	merged := finished[:1]
+	for _, r := range finished[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	c.finished = merged
+}
+
+func (c *Coordinator) loadState() error {
+	in, err := os.ReadFile(c.IntermediateStatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state coordinatorState
+	if err := json.Unmarshal(in, &state); err != nil {
+		return err
+	}
+
+	// Everything before the first unpulled DID, except what's to be pulled
+	// again
+	sort.Slice(state.Retry, func(i, j int) bool { return state.Retry[i] < state.Retry[j] })
+	start := uint64(1)
+	for _, index := range append(state.Retry, state.FirstUnpulledDidIndex) {
+		if index > start && start < state.FirstUnpulledDidIndex {
+			c.addFinished(start, min(index, state.FirstUnpulledDidIndex))
+		}
+		start = max(start, index+1)
+	}
+	for _, r := range state.Finished {
+		c.addFinished(r[0], r[1])
+	}
+	return nil
+}
+
+// Callers must hold c.lk.
+func (c *Coordinator) saveState() error {
+	state := coordinatorState{Finished: c.finished}
+	if len(c.finished) > 0 && c.finished[0][0] <= 1 {
+		state.FirstUnpulledDidIndex = c.finished[0][1]
+	}
+
+	out, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.IntermediateStatePath, out, 0644)
+}
+
+func newLeaseID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
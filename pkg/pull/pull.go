@@ -5,51 +5,96 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/ipfs/go-cid"
 	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/breaker"
 	"github.com/stanfordio/skyfall/pkg/census"
 	"github.com/stanfordio/skyfall/pkg/hydrator"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+	"github.com/stanfordio/skyfall/pkg/output"
 	// "github.com/bluesky-social/indigo/api/bsky"
 )
 
 type intermediateState struct {
-	FirstUnpulledDidIndex uint64 // All DIDs up to this one have been pulled, 1-indexed
+	FirstUnpulledDidIndex uint64   // All DIDs up to this one have been pulled, 1-indexed
+	Retry                 []uint64 // Except these, which are to be pulled again (e.g., because their rows weren't written)
 }
 
 type Pull struct {
 	CensusPath                  string
 	IntermediateStatePath       string
 	Output                      chan map[string]interface{}
+	Tracker                     *output.Tracker // If set, rows are sent through it, and DIDs only finish once their rows are written
 	Hydrator                    *hydrator.Hydrator
 	PdsEndpoint                 string
 	FirstUnpulledDidIndex       uint64   // 1-indexed, initialize to 0 by default
 	RecentlyPulledCensusIndices []uint64 // initialize to empty slice by default
 	CompletedIndicesChannel     chan uint64
+
+	// DIDs whose hosts had open circuit breakers, to retry in a later pass
+	deferredLk sync.Mutex
+	deferred   []*carPullRequest
+
+	unwritten sync.WaitGroup // DIDs pulled whose rows the output hasn't written yet
+
+	// DIDs to pull again next time, by census file index. The state
+	// management goroutine hears about them on retryIndices, as it does about
+	// pulled DIDs on CompletedIndicesChannel.
+	retryLk      sync.Mutex
+	retry        map[uint64]bool
+	retryIndices chan uint64
 }
 
+// Returned (wrapped) for downloads that failed because the host was down, i.e.,
+// its circuit breaker is open (whether or not this download is what opened it)
+var errHostDown = errors.New("host is down")
+
+// How many retry passes in a row may make no progress (i.e., every deferred DID
+// is deferred again) before we give up on the DIDs that are left
+const maxStalledRetryPasses = 3
+
 type carPullRequest struct {
 	pdsEndpoint     string
 	did             string
 	censusFileIndex uint64 // Given Bluesky's current size, this would overflow if we used uint32
+	err             error  // Why the DID couldn't be pulled, once it's finished
+	rows            *output.Batch
 }
 
+// Returned for DIDs that were pulled, but whose rows the output failed to write
+var errNotWritten = errors.New("rows not written")
+
 func (s *Pull) handleDownloadRequest(ctx context.Context, downloadRequest *carPullRequest) error {
 	// Download the car
 	log.Infof("Downloading car: %s from %s", downloadRequest.did, downloadRequest.pdsEndpoint)
 
-	// Eventually the state management goroutine that we've pulled this DID
-	defer func() { s.CompletedIndicesChannel <- downloadRequest.censusFileIndex }()
-
 	// Pull the bytes
 	repoBytes, err := s.Hydrator.GetRepoBytes(downloadRequest.did, downloadRequest.pdsEndpoint)
 	if err != nil {
-		log.Errorf("Failed to download car %s from %s: %v", downloadRequest.did, downloadRequest.pdsEndpoint, err)
-		return err
+		// The relay may not carry every repo (e.g., did:web accounts on
+		// self-hosted PDSes), or may be down, so try the PDS listed in the
+		// actor's DID document
+		pdsEndpoint, resolveErr := s.Hydrator.ResolvePDSEndpoint(downloadRequest.did)
+		if resolveErr != nil || pdsEndpoint == downloadRequest.pdsEndpoint {
+			log.Errorf("Failed to download car %s from %s: %v", downloadRequest.did, downloadRequest.pdsEndpoint, err)
+			return downloadError(downloadRequest.pdsEndpoint, err)
+		}
+
+		log.Infof("Failed to download car %s from %s, so trying its own PDS at %s", downloadRequest.did, downloadRequest.pdsEndpoint, pdsEndpoint)
+		repoBytes, err = s.Hydrator.GetRepoBytes(downloadRequest.did, pdsEndpoint)
+		if err != nil {
+			log.Errorf("Failed to download car %s from %s: %v", downloadRequest.did, pdsEndpoint, err)
+			return downloadError(pdsEndpoint, err)
+		}
 	}
 	repo, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(repoBytes))
 	if err != nil {
@@ -60,24 +105,32 @@ func (s *Pull) handleDownloadRequest(ctx context.Context, downloadRequest *carPu
 	actorDid := repo.RepoDid()
 
 	// Hydrate the car and send it to the output
+	if s.Tracker != nil {
+		downloadRequest.rows = s.Tracker.NewBatch()
+	}
 	err = repo.ForEach(ctx, "", func(k string, v cid.Cid) error {
 		// Grab the record from the merkel tree
-		_, rec, err := repo.GetRecord(ctx, k)
+		rc, rec, err := repo.GetRecord(ctx, k)
 		if err != nil {
 			log.Errorf("Failed to get record %s from car %s from %s: %v", v.String(), downloadRequest.did, downloadRequest.pdsEndpoint, err)
 			return err
 		}
 
 		// Hydrate the record
-		hydrated, err := s.Hydrator.Hydrate(rec, actorDid)
+		hydrated, err := s.Hydrator.Hydrate(rec, actorDid, k)
 		if err != nil {
 			log.Errorf("Failed to hydrate record: %+v", err)
 			return err
 		}
+		s.Hydrator.SetCID(hydrated, rc)
 
 		// Output the record (it'll be thrown into BigQuery or the
 		// output file)
-		s.Output <- hydrated
+		if downloadRequest.rows != nil {
+			downloadRequest.rows.Send(hydrated)
+		} else {
+			s.Output <- hydrated
+		}
 
 		return nil
 	})
@@ -90,18 +143,159 @@ func (s *Pull) handleDownloadRequest(ctx context.Context, downloadRequest *carPu
 	return nil
 }
 
+// downloadError wraps errHostDown around a failed download if the host it was
+// from is down, so that the DID is deferred rather than given up on.
+func downloadError(endpoint string, err error) error {
+	hostDown := errors.Is(err, breaker.ErrOpen)
+	if u, parseErr := url.Parse(endpoint); parseErr == nil && breaker.Shared.IsOpen(u.Host) {
+		hostDown = true
+	}
+	if hostDown {
+		return fmt.Errorf("%w: %w", errHostDown, err)
+	}
+	return err
+}
+
 func (s *Pull) startDownloader(ctx context.Context, numWorkers int, carChan chan *carPullRequest, wg *sync.WaitGroup) {
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			for downloadRequest := range carChan {
-				s.handleDownloadRequest(ctx, downloadRequest)
+				// Leave the rest unpulled if we're shutting down (or, for
+				// workers, have lost the lease on them)
+				if ctx.Err() != nil {
+					continue
+				}
+
+				err := s.handleDownloadRequest(ctx, downloadRequest)
+				if errors.Is(err, errHostDown) {
+					// Leave the DID unfinished (so the intermediate state
+					// doesn't move past it) and try again later
+					log.Infof("Deferring %s, since the circuit breaker for its host is open", downloadRequest.did)
+					s.deferRequest(downloadRequest)
+					continue
+				}
+				s.finishRequest(downloadRequest, err)
 			}
 			wg.Done()
 		}()
 	}
 }
 
+// finishRequest records that a DID was pulled (or failed for good), once the
+// output has written its rows.
+func (s *Pull) finishRequest(downloadRequest *carPullRequest, err error) {
+	if downloadRequest.rows == nil {
+		s.finished(downloadRequest, err)
+		return
+	}
+
+	s.unwritten.Add(1)
+	downloadRequest.rows.Close(func(written bool) {
+		defer s.unwritten.Done()
+		if err == nil && !written {
+			log.Errorf("Failed to write some of the rows from %s", downloadRequest.did)
+			err = errNotWritten
+		}
+		s.finished(downloadRequest, err)
+	})
+}
+
+func (s *Pull) finished(downloadRequest *carPullRequest, err error) {
+	if err != nil {
+		metrics.PullDIDs.WithLabelValues("failed").Inc()
+	} else {
+		metrics.PullDIDs.WithLabelValues("done").Inc()
+	}
+	metrics.PullDIDsRemaining.Dec()
+	downloadRequest.err = err
+
+	// Eventually the state management goroutine that we've pulled this DID
+	// (workers don't have one, since the coordinator keeps track). DIDs that
+	// are worth another try (i.e., their rows weren't written, or their host
+	// stayed down) are saved for next time instead.
+	if s.CompletedIndicesChannel != nil {
+		if errors.Is(err, errNotWritten) || errors.Is(err, errHostDown) {
+			s.retryIndices <- downloadRequest.censusFileIndex
+		} else {
+			s.CompletedIndicesChannel <- downloadRequest.censusFileIndex
+		}
+	}
+}
+
+func (s *Pull) deferRequest(downloadRequest *carPullRequest) {
+	s.deferredLk.Lock()
+	defer s.deferredLk.Unlock()
+	s.deferred = append(s.deferred, downloadRequest)
+	metrics.PullDIDsDeferred.Set(float64(len(s.deferred)))
+}
+
+func (s *Pull) takeDeferred() []*carPullRequest {
+	s.deferredLk.Lock()
+	defer s.deferredLk.Unlock()
+	deferred := s.deferred
+	s.deferred = nil
+	metrics.PullDIDsDeferred.Set(0)
+	return deferred
+}
+
+// retryDeferred retries DIDs that were deferred because their hosts' circuit
+// breakers were open, waiting out the breakers' cooldown before each pass. It
+// keeps going until there's nothing left to retry, or until enough passes in a
+// row make no progress, at which point the DIDs that are left count as failed.
+func (s *Pull) retryDeferred(ctx context.Context, numWorkers int) error {
+	stalled := 0
+	for pass := 1; ; pass++ {
+		deferred := s.takeDeferred()
+		if len(deferred) == 0 {
+			return nil
+		}
+
+		if stalled >= maxStalledRetryPasses {
+			log.Errorf("Giving up on %d DIDs whose hosts' circuit breakers stayed open", len(deferred))
+			for _, downloadRequest := range deferred {
+				s.finishRequest(downloadRequest, errHostDown)
+			}
+			return nil
+		}
+
+		cooldown := breaker.Shared.Cooldown()
+		log.Infof("Retrying %d deferred DIDs in %s (pass %d)", len(deferred), cooldown, pass)
+		select {
+		case <-time.After(cooldown):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// Start with a single DID, so that it alone probes its host (a
+		// half-open breaker only lets one request through), and the rest
+		// follow once the breaker has closed
+		s.downloadAll(ctx, 1, deferred[:1])
+		s.downloadAll(ctx, numWorkers, deferred[1:])
+
+		s.deferredLk.Lock()
+		if len(s.deferred) < len(deferred) {
+			stalled = 0
+		} else {
+			stalled++
+		}
+		s.deferredLk.Unlock()
+	}
+}
+
+// downloadAll downloads the given DIDs and waits for them to finish.
+func (s *Pull) downloadAll(ctx context.Context, numWorkers int, downloadRequests []*carPullRequest) {
+	carChan := make(chan *carPullRequest, len(downloadRequests))
+	for _, downloadRequest := range downloadRequests {
+		carChan <- downloadRequest
+	}
+	close(carChan)
+
+	var wg sync.WaitGroup
+	s.startDownloader(ctx, numWorkers, carChan, &wg)
+	wg.Wait()
+}
+
 func (s *Pull) saveIntermediateStateToDisk() error {
 	// Saves the pull queue and the completed queue to disk so that we can
 	// resume the download later if needed.
@@ -109,6 +303,12 @@ func (s *Pull) saveIntermediateStateToDisk() error {
 	state := intermediateState{
 		FirstUnpulledDidIndex: s.FirstUnpulledDidIndex,
 	}
+	s.retryLk.Lock()
+	for index := range s.retry {
+		state.Retry = append(state.Retry, index)
+	}
+	s.retryLk.Unlock()
+	sort.Slice(state.Retry, func(i, j int) bool { return state.Retry[i] < state.Retry[j] })
 
 	// Marshall into json
 	out, err := json.Marshal(state)
@@ -146,13 +346,31 @@ func (s *Pull) loadIntermediateStateFromDisk() error {
 		}
 
 		s.FirstUnpulledDidIndex = state.FirstUnpulledDidIndex
+		s.retryLk.Lock()
+		for _, index := range state.Retry {
+			s.retry[index] = true
+		}
+		s.retryLk.Unlock()
 	}
 
 	return nil
 }
 
 func (s *Pull) keepIntermediateStateUpdated() {
-	for completedIndex := range s.CompletedIndicesChannel {
+	for {
+		// Either way, the DID is handled for this run
+		var completedIndex uint64
+		select {
+		case completedIndex = <-s.CompletedIndicesChannel:
+			s.retryLk.Lock()
+			delete(s.retry, completedIndex)
+			s.retryLk.Unlock()
+		case completedIndex = <-s.retryIndices:
+			s.retryLk.Lock()
+			s.retry[completedIndex] = true
+			s.retryLk.Unlock()
+		}
+
 		// Add the completed index to the list of completed indices
 		s.RecentlyPulledCensusIndices = append(s.RecentlyPulledCensusIndices, completedIndex)
 
@@ -165,7 +383,8 @@ func (s *Pull) keepIntermediateStateUpdated() {
 		// increment the first element and remove it from the list
 		log.Debugf("First unpulled DID index: %d, earliest unprocessed: %d", s.FirstUnpulledDidIndex, s.RecentlyPulledCensusIndices[0])
 		for len(s.RecentlyPulledCensusIndices) > 0 && s.RecentlyPulledCensusIndices[0] <= s.FirstUnpulledDidIndex {
-			s.FirstUnpulledDidIndex = s.RecentlyPulledCensusIndices[0] + 1
+			// (DIDs pulled again from an earlier run are further back)
+			s.FirstUnpulledDidIndex = max(s.FirstUnpulledDidIndex, s.RecentlyPulledCensusIndices[0]+1)
 			s.RecentlyPulledCensusIndices = s.RecentlyPulledCensusIndices[1:]
 		}
 
@@ -181,20 +400,39 @@ func (s *Pull) BeginDownloading(ctx context.Context, numWorkers int) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	s.retry = make(map[uint64]bool)
+	s.retryIndices = make(chan uint64, cap(s.CompletedIndicesChannel))
 	err := s.loadIntermediateStateFromDisk()
 	if err != nil {
 		log.Errorf("Failed to load intermediate state from disk: %v", err)
 		return err
 	}
 
+	// DIDs that the last run saved to pull again
+	retry := make(map[uint64]bool)
+	for index := range s.retry {
+		retry[index] = true
+	}
+	if len(retry) > 0 {
+		log.Infof("Pulling %d DIDs again that earlier runs couldn't finish", len(retry))
+	}
+
 	// Start the downloader
 	carDownloadChannel := make(chan *carPullRequest, 10000)
 	var wg sync.WaitGroup
-	go s.startDownloader(ctx, numWorkers, carDownloadChannel, &wg)
+	s.startDownloader(ctx, numWorkers, carDownloadChannel, &wg)
 
 	// Start the intermediate state manager
 	go s.keepIntermediateStateUpdated()
 
+	// Count the DIDs to pull, for progress reporting
+	total, err := countLines(s.CensusPath)
+	if err != nil {
+		log.Errorf("Failed to count DIDs in census file: %v", err)
+		return err
+	}
+	metrics.PullDIDsRemaining.Set(float64(total))
+
 	// Open the census file
 	censusFile, err := os.Open(s.CensusPath)
 	if err != nil {
@@ -212,8 +450,9 @@ func (s *Pull) BeginDownloading(ctx context.Context, numWorkers int) error {
 		index++
 
 		// First, check if we've already pulled this DID
-		if index < s.FirstUnpulledDidIndex {
+		if index < s.FirstUnpulledDidIndex && !retry[lineIndex] {
 			// Skip this DID
+			metrics.PullDIDsRemaining.Dec()
 			continue
 		}
 
@@ -244,6 +483,11 @@ func (s *Pull) BeginDownloading(ctx context.Context, numWorkers int) error {
 	wg.Wait()
 	log.Infof("Downloaders finished on %s", s.PdsEndpoint)
 
+	// Then retry the DIDs whose hosts were down the first time around
+	if err := s.retryDeferred(ctx, numWorkers); err != nil {
+		return err
+	}
+
 	// Close the output channel
 	close(s.Output)
 
@@ -252,3 +496,18 @@ func (s *Pull) BeginDownloading(ctx context.Context, numWorkers int) error {
 
 	return nil
 }
+
+func countLines(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count++
+	}
+	return count, scanner.Err()
+}
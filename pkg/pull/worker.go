@@ -0,0 +1,264 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+	"github.com/stanfordio/skyfall/pkg/utils"
+)
+
+// How long a worker waits before asking again when every range left is leased
+// to someone else
+const leasePollInterval = 10 * time.Second
+
+var (
+	// The coordinator has nothing left to lease
+	errNoLeasesLeft = errors.New("no leases left")
+
+	// The coordinator has nothing to lease right now, but may later (e.g., if
+	// someone else's lease expires)
+	errNoLeaseAvailable = errors.New("no lease available")
+
+	// The lease expired, and may have gone to someone else
+	errLeaseLost = errors.New("lease lost")
+)
+
+// DefaultWorkerID names a worker after where it runs.
+func DefaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// BeginWorking pulls ranges of the census leased from a coordinator (see
+// Coordinator), rather than reading the census itself, until the coordinator
+// has none left.
+func (s *Pull) BeginWorking(ctx context.Context, coordinatorURL string, workerID string, numWorkers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	coordinator := &coordinatorClient{
+		url:    strings.TrimSuffix(coordinatorURL, "/"),
+		client: utils.RetryingHTTPClient(),
+	}
+
+	for {
+		lease, err := coordinator.lease(ctx, workerID)
+		if errors.Is(err, errNoLeasesLeft) {
+			log.Infof("Coordinator has no leases left, so we're done")
+			break
+		}
+		if errors.Is(err, errNoLeaseAvailable) {
+			log.Debugf("Coordinator has no leases available; asking again in %s", leasePollInterval)
+			select {
+			case <-time.After(leasePollInterval):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to get a lease from the coordinator: %v", err)
+			return err
+		}
+
+		if err := s.pullLease(ctx, coordinator, lease, numWorkers); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, errLeaseLost) {
+				log.Warnf("Lost the lease on DIDs %d-%d, so leaving them to whoever has it now", lease.Start, lease.End-1)
+				continue
+			}
+			return err
+		}
+	}
+
+	// Close the output channel
+	close(s.Output)
+
+	<-ctx.Done()
+	log.Infof("Shutting down...")
+
+	return nil
+}
+
+// pullLease pulls every DID in a lease (heartbeating while it does), and then
+// reports how it went.
+func (s *Pull) pullLease(ctx context.Context, coordinator *coordinatorClient, lease *Lease, numWorkers int) error {
+	log.Infof("Pulling DIDs %d-%d", lease.Start, lease.End-1)
+
+	leaseCtx, cancelLease := context.WithCancel(ctx)
+	defer cancelLease()
+
+	lost := make(chan struct{})
+	go func() {
+		if err := coordinator.keepAlive(leaseCtx, lease); errors.Is(err, errLeaseLost) {
+			close(lost)
+			cancelLease()
+		}
+	}()
+
+	downloadRequests := make([]*carPullRequest, len(lease.DIDs))
+	for i, did := range lease.DIDs {
+		downloadRequests[i] = &carPullRequest{
+			pdsEndpoint:     s.PdsEndpoint,
+			did:             did,
+			censusFileIndex: lease.Start + uint64(i),
+		}
+	}
+	metrics.PullDIDsRemaining.Add(float64(len(downloadRequests)))
+
+	s.downloadAll(leaseCtx, numWorkers, downloadRequests)
+	retryErr := s.retryDeferred(leaseCtx, numWorkers)
+
+	select {
+	case <-lost:
+		// Whatever's left is for whoever has the lease now
+		s.takeDeferred()
+		return errLeaseLost
+	default:
+	}
+	if retryErr != nil {
+		return retryErr
+	}
+
+	// Only report the DIDs once the output has written their rows, since the
+	// coordinator won't lease them again
+	written := make(chan struct{})
+	go func() {
+		s.unwritten.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	report := reportRequest{ID: lease.ID}
+	for _, downloadRequest := range downloadRequests {
+		if downloadRequest.err != nil {
+			report.Failed = append(report.Failed, downloadRequest.did)
+		} else {
+			report.Done++
+		}
+	}
+	return coordinator.report(ctx, report)
+}
+
+type coordinatorClient struct {
+	url    string
+	client *http.Client
+}
+
+// call POSTs a request to the coordinator, decoding the response (if it's a
+// 200) into out, and returns the response's status.
+func (c *coordinatorClient) call(ctx context.Context, path string, in interface{}, out interface{}) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *coordinatorClient) lease(ctx context.Context, workerID string) (*Lease, error) {
+	var lease Lease
+	status, err := c.call(ctx, "/lease", leaseRequest{Worker: workerID}, &lease)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return &lease, nil
+	case http.StatusNoContent:
+		return nil, errNoLeaseAvailable
+	case http.StatusGone:
+		return nil, errNoLeasesLeft
+	default:
+		return nil, fmt.Errorf("unexpected status from coordinator: %d", status)
+	}
+}
+
+// keepAlive renews a lease (well before it expires) until the context is
+// cancelled, or the lease is lost. Expiry is tracked by our own clock, from
+// the lease's TTL, so that it doesn't matter if the coordinator's differs.
+func (c *coordinatorClient) keepAlive(ctx context.Context, lease *Lease) error {
+	expires := time.Now().Add(lease.TTL)
+	for {
+		select {
+		case <-time.After(lease.TTL / 3):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		sent := time.Now()
+		status, err := c.call(ctx, "/heartbeat", heartbeatRequest{ID: lease.ID}, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Keep trying until the lease actually runs out
+			log.Warnf("Failed to renew lease on DIDs %d-%d: %v", lease.Start, lease.End-1, err)
+			if time.Now().After(expires) {
+				return errLeaseLost
+			}
+			continue
+		}
+
+		switch status {
+		case http.StatusOK:
+			expires = sent.Add(lease.TTL)
+		case http.StatusGone:
+			return errLeaseLost
+		default:
+			log.Warnf("Unexpected status renewing lease on DIDs %d-%d: %d", lease.Start, lease.End-1, status)
+		}
+	}
+}
+
+func (c *coordinatorClient) report(ctx context.Context, report reportRequest) error {
+	status, err := c.call(ctx, "/report", report, nil)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errLeaseLost
+	default:
+		return fmt.Errorf("unexpected status from coordinator: %d", status)
+	}
+}
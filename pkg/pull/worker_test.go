@@ -0,0 +1,131 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/stanfordio/skyfall/pkg/census"
+	"github.com/stanfordio/skyfall/pkg/hydrator"
+	"github.com/stanfordio/skyfall/pkg/output"
+	"github.com/stanfordio/skyfall/pkg/output/buffer"
+	"github.com/stanfordio/skyfall/pkg/testsupport"
+)
+
+// A lease whose rows don't fill the sink's buffer is still reported, once the
+// buffer has waited long enough to flush them, and not before.
+func TestWorkerReportsLeaseOnceRowsAreFlushed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	network := testsupport.NewNetwork()
+	defer network.Close()
+
+	censusPath := filepath.Join(dir, "census.jsonl")
+	censusFile, err := os.Create(censusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := 0
+	for _, handle := range []string{"alice.test", "bob.test"} {
+		account, err := network.CreateAccount(ctx, handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			post := &bsky.FeedPost{Text: "hello", CreatedAt: time.Now().Format(time.RFC3339)}
+			if _, _, err := network.CreateRecord(ctx, account, "app.bsky.feed.post", post); err != nil {
+				t.Fatal(err)
+			}
+			records++
+		}
+		if err := json.NewEncoder(censusFile).Encode(census.CensusFileEntry{Did: account.DID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	censusFile.Close()
+
+	// Coordinate on a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	coordinator := &Coordinator{
+		CensusPath:            censusPath,
+		IntermediateStatePath: statePath,
+		LeaseSize:             DefaultLeaseSize,
+		LeaseTTL:              time.Minute,
+	}
+	go coordinator.Serve(ctx, addr)
+	for {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A sink that only writes (and acknowledges) rows in batches far bigger
+	// than the lease
+	outputChannel := make(chan map[string]interface{}, 100)
+	tracker := output.NewTracker(outputChannel)
+	var lk sync.Mutex
+	written := 0
+	sink := buffer.Buffer{
+		Size:     250,
+		MaxDelay: 100 * time.Millisecond,
+		Flush: func(ctx context.Context, rows []map[string]interface{}) error {
+			lk.Lock()
+			defer lk.Unlock()
+			written += len(rows)
+			return nil
+		},
+		Acknowledge: tracker.Acknowledge,
+	}
+	go sink.Run(ctx, outputChannel)
+
+	h, err := hydrator.MakeHydrator(ctx, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Configure(h)
+	h.Level = hydrator.HydrationNone
+
+	worker := &Pull{
+		Output:      outputChannel,
+		Tracker:     tracker,
+		Hydrator:    h,
+		PdsEndpoint: network.URL(),
+	}
+	go worker.BeginWorking(ctx, "http://"+addr, "test", 2)
+
+	// Wait for the coordinator to save the lease as finished
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var state coordinatorState
+		if data, err := os.ReadFile(statePath); err == nil && json.Unmarshal(data, &state) == nil && state.FirstUnpulledDidIndex > 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the worker to report its lease")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if written != records {
+		t.Errorf("Lease was reported with %d of its %d rows written", written, records)
+	}
+}
@@ -0,0 +1,66 @@
+package shard
+
+// Splitting work between instances by actor. Each DID belongs to exactly one
+// of M shards, going by a hash of the DID that outputs can also compute (e.g.,
+// in SQL, to find where a shard left off): the first four bytes of its SHA-256,
+// as a big-endian unsigned integer, modulo M.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shard is one of Count shards. The zero value is everything, unsharded.
+type Shard struct {
+	Index int // From 0, though shards are numbered from 1 (N/M) for people
+	Count int
+}
+
+// Parse parses a shard in N/M form, e.g., 2/4 for the second of four.
+func Parse(value string) (Shard, error) {
+	n, m, ok := strings.Cut(value, "/")
+	if !ok {
+		return Shard{}, fmt.Errorf("invalid shard %q: expected N/M", value)
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(n))
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q: expected N/M", value)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(m))
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q: expected N/M", value)
+	}
+	if count < 1 || index < 1 || index > count {
+		return Shard{}, fmt.Errorf("invalid shard %q: expected 1 <= N <= M", value)
+	}
+	return Shard{Index: index - 1, Count: count}, nil
+}
+
+// Sharded reports whether the shard is less than everything.
+func (s Shard) Sharded() bool {
+	return s.Count > 1
+}
+
+// Owns reports whether the DID belongs to the shard.
+func (s Shard) Owns(did string) bool {
+	if !s.Sharded() {
+		return true
+	}
+	return int(Hash(did)%uint32(s.Count)) == s.Index
+}
+
+func (s Shard) String() string {
+	if !s.Sharded() {
+		return "1/1"
+	}
+	return fmt.Sprintf("%d/%d", s.Index+1, s.Count)
+}
+
+// Hash is what DIDs are sharded by.
+func Hash(did string) uint32 {
+	sum := sha256.Sum256([]byte(did))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/repo"
@@ -25,6 +26,8 @@ import (
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/gorilla/websocket"
 	hydrator "github.com/stanfordio/skyfall/pkg/hydrator"
+	"github.com/stanfordio/skyfall/pkg/metrics"
+	"github.com/stanfordio/skyfall/pkg/shard"
 )
 
 type Stream struct {
@@ -33,6 +36,33 @@ type Stream struct {
 	Output      chan map[string]interface{}
 	Hydrator    *hydrator.Hydrator
 	BackfillSeq int64
+	Verify      bool        // Verify commit signatures and MST proofs, recording the result in each row's Verified field
+	Shard       shard.Shard // Only handle commits from actors in this shard (the zero value is all of them)
+
+	// Workers handle commits out of order, so restarts pick up from just before
+	// the oldest commit still in flight (or after the newest one, if none are)
+	lk       sync.Mutex
+	inFlight map[int64]int // Seqs of commits handed to workers but not yet handled
+	newest   int64         // Highest seq handed to workers
+}
+
+// trackingScheduler notes each commit's seq as it's handed to the workers
+type trackingScheduler struct {
+	events.Scheduler
+	stream *Stream
+}
+
+func (t *trackingScheduler) AddWork(ctx context.Context, repo string, val *events.XRPCStreamEvent) error {
+	if val.RepoCommit == nil {
+		return t.Scheduler.AddWork(ctx, repo, val)
+	}
+
+	t.stream.startCommit(val.RepoCommit.Seq)
+	err := t.Scheduler.AddWork(ctx, repo, val)
+	if err != nil {
+		t.stream.finishCommit(val.RepoCommit.Seq)
+	}
+	return err
 }
 
 func (s *Stream) BeginStreaming(ctx context.Context, workerCount int) error {
@@ -44,14 +74,18 @@ func (s *Stream) BeginStreaming(ctx context.Context, workerCount int) error {
 	scalingSettings.Concurrency = workerCount / 2
 	scalingSettings.MaxConcurrency = workerCount
 
-	pool := autoscaling.NewScheduler(scalingSettings, s.SocketURL.Host, s.HandleStreamEvent)
+	pool := &trackingScheduler{
+		Scheduler: autoscaling.NewScheduler(scalingSettings, s.SocketURL.Host, s.HandleStreamEvent),
+		stream:    s,
+	}
 
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 
 	var socketUrl string = s.SocketURL.String()
-	// If we're backfilling, add the backfill seq to the socket url
-	if s.BackfillSeq > 0 {
-		socketUrl = fmt.Sprintf("%s?cursor=%d", socketUrl, s.BackfillSeq)
+	// If we're backfilling (or restarting), add the seq to pick up from to the
+	// socket url
+	if cursor := max(s.BackfillSeq, s.resumeCursor()); cursor > 0 {
+		socketUrl = fmt.Sprintf("%s?cursor=%d", socketUrl, cursor)
 	}
 
 	log.Infof("Connecting to WebSocket at: %s", socketUrl)
@@ -65,6 +99,9 @@ func (s *Stream) BeginStreaming(ctx context.Context, workerCount int) error {
 	}
 	defer c.Close()
 
+	metrics.SetReady("firehose", true)
+	defer metrics.SetReady("firehose", false)
+
 	go func() {
 		err = events.HandleRepoStream(ctx, c, pool, logger)
 		log.Infof("HandleRepoStream returned unexpectedly: %+v...", err)
@@ -83,6 +120,7 @@ func (s *Stream) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEve
 	}
 
 	if xe.RepoCommit != nil {
+		defer s.finishCommit(xe.RepoCommit.Seq)
 		return s.HandleRepoCommit(ctx, xe.RepoCommit)
 	} else {
 		log.Warnf("Unknown stream event: %+v", xe)
@@ -91,6 +129,19 @@ func (s *Stream) HandleStreamEvent(ctx context.Context, xe *events.XRPCStreamEve
 }
 
 func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) (error error) {
+	metrics.FirehoseSeq.Set(float64(evt.Seq))
+	if committedAt, err := time.Parse(time.RFC3339, evt.Time); err == nil {
+		metrics.FirehoseLag.Set(time.Since(committedAt).Seconds())
+	}
+	metrics.Progress()
+
+	// Other instances handle other shards' commits, so there's no need to even
+	// read them
+	if !s.Shard.Owns(evt.Repo) {
+		metrics.ShardSkipped.Inc()
+		return nil
+	}
+
 	rr, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
 	if err != nil {
 		log.Warnf("Failed to read repo from car: %+v", err)
@@ -102,8 +153,16 @@ func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubsc
 
 	error = nil
 
+	// The commit is verified once per event; each op then gets its own proof
+	// checked against the signed tree
+	var verification *commitVerification
+	if s.Verify {
+		verification = s.verifyCommit(ctx, evt, rr)
+	}
+
 	for _, op := range evt.Ops {
 		collection := strings.Split(op.Path, "/")[0]
+		metrics.Events.WithLabelValues(collection, op.Action).Inc()
 
 		ek := repomgr.EventKind(op.Action)
 		log_wf := log.WithFields(log.Fields{"action": op.Action, "collection": collection})
@@ -111,24 +170,33 @@ func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubsc
 		switch ek {
 		case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
 			// Grab the record from the merkel tree
+			var record interface{}
 			rc, rec, err := rr.GetRecord(ctx, op.Path)
 			if err != nil {
 				e := fmt.Errorf("getting record %s (%s) within seq %d for %s: %w", op.Path, *op.Cid, evt.Seq, evt.Repo, err)
 				log_wf.Errorf("Failed to get a record from the event: %+v", e)
 				error = e
-				break
+				// When verifying, the failure is recorded rather than dropped
+				if verification == nil {
+					break
+				}
+				record = placeholderRecord(op.Path)
+			} else {
+				record = rec
 			}
 
 			// Verify that the record cid matches the cid in the event
-			if lexutil.LexLink(rc) != *op.Cid {
+			if err == nil && lexutil.LexLink(rc) != *op.Cid {
 				e := fmt.Errorf("mismatch in record and op cid: %s != %s", rc, *op.Cid)
 				log_wf.Errorf("Failed to LexLink the record in the event: %+v", e)
 				error = e
-				break
+				if verification == nil {
+					break
+				}
 			}
 
 			// Hydrate the record
-			hydrated, err := s.Hydrator.Hydrate(rec, actorDid)
+			hydrated, err := s.Hydrator.Hydrate(record, actorDid, op.Path)
 			if err != nil {
 				log_wf.Errorf("Failed to hydrate record: %+v", err)
 				error = err
@@ -140,11 +208,15 @@ func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubsc
 			// Include the event sequence number
 			hydrated["Seq"] = evt.Seq
 
+			if verification != nil {
+				hydrated["Verified"] = verification.opStatus(ctx, op)
+			}
+
 			s.Output <- hydrated
 
 		case repomgr.EvtKindDeleteRecord:
 			// Not much we can do here, since we don't have the record anymore; just log the action
-			hydrated, err := s.Hydrator.Hydrate(map[string]interface{}{"CreatedAt": time.Now().Format(time.RFC3339), "Item": op.Path, "LexiconTypeID": strings.Split(op.Path, "/")[0]}, actorDid)
+			hydrated, err := s.Hydrator.Hydrate(placeholderRecord(op.Path), actorDid, op.Path)
 			if err != nil {
 				log_wf.Errorf("Failed to hydrate record: %+v", err)
 				error = err
@@ -154,6 +226,10 @@ func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubsc
 			hydrated["Action"] = op.Action
 			hydrated["Seq"] = evt.Seq
 
+			if verification != nil {
+				hydrated["Verified"] = verification.opStatus(ctx, op)
+			}
+
 			s.Output <- hydrated
 		default:
 			log.Warnf("Unknown event kind from op action: %+v", op.Action)
@@ -162,3 +238,40 @@ func (s *Stream) HandleRepoCommit(ctx context.Context, evt *comatproto.SyncSubsc
 
 	return
 }
+
+func (s *Stream) startCommit(seq int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.inFlight == nil {
+		s.inFlight = make(map[int64]int)
+	}
+	s.inFlight[seq]++
+	s.newest = max(s.newest, seq)
+}
+
+func (s *Stream) finishCommit(seq int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.inFlight[seq]--; s.inFlight[seq] <= 0 {
+		delete(s.inFlight, seq)
+	}
+}
+
+// The seq to pick up after: every commit up to and including it was handled
+func (s *Stream) resumeCursor() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	cursor := s.newest
+	for seq := range s.inFlight {
+		cursor = min(cursor, seq-1)
+	}
+	return cursor
+}
+
+// Stands in for a record we don't have (e.g., because it was deleted)
+func placeholderRecord(path string) map[string]interface{} {
+	return map[string]interface{}{"CreatedAt": time.Now().Format(time.RFC3339), "Item": path, "LexiconTypeID": strings.Split(path, "/")[0]}
+}
@@ -0,0 +1,180 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/indigo/repomgr"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statuses recorded in the `Verified` field of each row when verification is
+// enabled
+const (
+	VerifiedValid            = "valid"             // Signed by the repo's signing key, with a complete proof for the op
+	VerifiedInvalidSignature = "invalid-signature" // The commit isn't signed by the repo's current signing key
+	VerifiedUnresolvedKey    = "unresolved-key"    // We couldn't resolve the repo's signing key, so the signature is unchecked
+	VerifiedInvalidProof     = "invalid-proof"     // The signed tree contradicts the op
+	VerifiedIncompleteProof  = "incomplete-proof"  // The event is missing blocks needed to prove the op
+)
+
+type commitVerification struct {
+	Status string                // Status of the commit itself; ops can only be valid if this is
+	Tree   *mst.MerkleSearchTree // The signed MST, if we could find the commit
+	Repo   *repo.Repo
+}
+
+// Verifies that the event's commit is present in its CAR slice, belongs to the
+// event's repo, and is signed by the repo's signing key.
+func (s *Stream) verifyCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit, rr *repo.Repo) *commitVerification {
+	log_wf := log.WithFields(log.Fields{"repo": evt.Repo, "seq": evt.Seq})
+	verification := &commitVerification{Repo: rr}
+
+	cst := util.CborStore(rr.Blockstore())
+	var sc repo.SignedCommit
+	if err := cst.Get(ctx, cid.Cid(evt.Commit), &sc); err != nil {
+		log_wf.Warnf("Commit %s is not in the event's blocks: %+v", evt.Commit, err)
+		verification.Status = VerifiedIncompleteProof
+		return verification
+	}
+
+	if sc.Did != evt.Repo {
+		log_wf.Warnf("Commit belongs to %s, not %s", sc.Did, evt.Repo)
+		verification.Status = VerifiedInvalidProof
+		return verification
+	}
+
+	verification.Tree = mst.LoadMST(cst, sc.Data)
+
+	signed, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		log_wf.Warnf("Failed to serialize commit for signature verification: %+v", err)
+		verification.Status = VerifiedInvalidProof
+		return verification
+	}
+
+	var unresolved *unresolvedKeyError
+	err = s.verifySignature(evt.Repo, signed, sc.Sig, false)
+	if err != nil && !errors.As(err, &unresolved) {
+		// The key may have been rotated since we cached the identity, so try
+		// again with a fresh one before giving up. (If we couldn't resolve the
+		// key at all, a fresh lookup would most likely fail the same way.)
+		log_wf.Debugf("Signature verification failed, retrying with a fresh identity: %+v", err)
+		err = s.verifySignature(evt.Repo, signed, sc.Sig, true)
+	}
+
+	switch {
+	case errors.As(err, &unresolved):
+		log_wf.Warnf("Failed to resolve signing key: %+v", err)
+		verification.Status = VerifiedUnresolvedKey
+	case err != nil:
+		log_wf.Warnf("Invalid commit signature: %+v", err)
+		verification.Status = VerifiedInvalidSignature
+	default:
+		verification.Status = VerifiedValid
+	}
+
+	return verification
+}
+
+type unresolvedKeyError struct {
+	err error
+}
+
+func (e *unresolvedKeyError) Error() string {
+	return fmt.Sprintf("unresolved signing key: %v", e.err)
+}
+
+func (e *unresolvedKeyError) Unwrap() error {
+	return e.err
+}
+
+func (s *Stream) verifySignature(did string, signed []byte, sig []byte, refresh bool) error {
+	lookup := s.Hydrator.LookupIdentity
+	if refresh {
+		lookup = s.Hydrator.RefreshIdentity
+	}
+
+	identity, err := lookup(did)
+	if err != nil {
+		return &unresolvedKeyError{err}
+	}
+
+	key, err := identity.PublicKey()
+	if err != nil {
+		return &unresolvedKeyError{err}
+	}
+
+	// Some older commits have high-S signatures, which are still signatures
+	// by this key as far as provenance goes
+	return key.HashAndVerifyLenient(signed, sig)
+}
+
+// Returns the verification status of a single op: whether the signed tree
+// includes the op's record (for creates and updates) or excludes its path (for
+// deletes).
+func (v *commitVerification) opStatus(ctx context.Context, op *comatproto.SyncSubscribeRepos_RepoOp) string {
+	if v.Tree == nil || v.Status == VerifiedIncompleteProof || v.Status == VerifiedInvalidProof {
+		return v.Status
+	}
+
+	status := v.proofStatus(ctx, op)
+	if status != VerifiedValid {
+		return status
+	}
+
+	// The proof is sound, but it's only as good as the signature over its root
+	return v.Status
+}
+
+func (v *commitVerification) proofStatus(ctx context.Context, op *comatproto.SyncSubscribeRepos_RepoOp) string {
+	log_wf := log.WithFields(log.Fields{"action": op.Action, "path": op.Path})
+
+	val, err := v.Tree.Get(ctx, op.Path)
+
+	switch repomgr.EventKind(op.Action) {
+	case repomgr.EvtKindCreateRecord, repomgr.EvtKindUpdateRecord:
+		if errors.Is(err, mst.ErrNotFound) {
+			log_wf.Warnf("Signed tree does not include %s", op.Path)
+			return VerifiedInvalidProof
+		}
+		if err != nil {
+			log_wf.Warnf("Failed to walk the signed tree to %s: %+v", op.Path, err)
+			return VerifiedIncompleteProof
+		}
+		if op.Cid == nil || cid.Cid(*op.Cid) != val {
+			log_wf.Warnf("Signed tree has %s at %s, but the op says %v", val, op.Path, op.Cid)
+			return VerifiedInvalidProof
+		}
+
+		// Blocks were already checked against their CIDs when we read the CAR
+		// slice, so all that's left is to make sure the record is actually there
+		has, err := v.Repo.Blockstore().Has(ctx, val)
+		if err != nil || !has {
+			log_wf.Warnf("Record block %s is not in the event's blocks", val)
+			return VerifiedIncompleteProof
+		}
+
+		return VerifiedValid
+
+	case repomgr.EvtKindDeleteRecord:
+		if errors.Is(err, mst.ErrNotFound) {
+			return VerifiedValid
+		}
+		if err != nil {
+			log_wf.Warnf("Failed to walk the signed tree to %s: %+v", op.Path, err)
+			return VerifiedIncompleteProof
+		}
+		log_wf.Warnf("Signed tree still includes deleted record %s", op.Path)
+		return VerifiedInvalidProof
+
+	default:
+		return VerifiedInvalidProof
+	}
+}
@@ -0,0 +1,409 @@
+// Package testsupport is a fake, in-process Bluesky network for testing skyfall
+// end to end without network access. A single local HTTP server plays the
+// relay (subscribeRepos, listRepos, getRepo), the PDS (createSession), the
+// AppView (getPosts, getProfile) and the PLC directory, all backed by repos
+// that are built and signed in memory.
+//
+// A typical test creates a network, adds some accounts and records, and then
+// points skyfall at it:
+//
+//	network := testsupport.NewNetwork()
+//	defer network.Close()
+//
+//	alice, _ := network.CreateAccount(ctx, "alice.test")
+//	network.CreateRecord(ctx, alice, "app.bsky.feed.post", &bsky.FeedPost{...})
+//
+//	h, _ := hydrator.MakeHydrator(ctx, 1<<20, nil)
+//	network.Configure(h)
+//	s := stream.Stream{SocketURL: network.SubscribeReposURL(), Hydrator: h, ...}
+//
+// The same hosts can be passed to the CLI with --relay-host, --appview-host,
+// --plc-host and --pds-endpoint.
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/stanfordio/skyfall/pkg/hydrator"
+)
+
+// Password that every fake account is created with
+const DefaultPassword = "password"
+
+type Account struct {
+	DID       string
+	Handle    string
+	Password  string
+	Key       *crypto.PrivateKeyK256
+	CreatedAt time.Time
+
+	repo *repo.Repo
+	bs   blockstore.Blockstore
+	head cid.Cid
+	rev  string
+}
+
+type Network struct {
+	Server *httptest.Server
+
+	// How long the session tokens that the fake PDS hands out last (two hours
+	// and 90 days, like Bluesky's, unless changed)
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+
+	lk       sync.Mutex
+	accounts []*Account
+	byDID    map[string]*Account
+	byHandle map[string]*Account
+	events   []*events.XRPCStreamEvent // events[i] has seq i+1
+	updated  chan struct{}             // Closed (and replaced) whenever an event is added
+	done     chan struct{}
+}
+
+var _ identity.Directory = (*Network)(nil)
+
+// NewNetwork starts a fake network on a local port. Call Close when done.
+func NewNetwork() *Network {
+	n := &Network{
+		AccessTokenLifetime:  2 * time.Hour,
+		RefreshTokenLifetime: 90 * 24 * time.Hour,
+		byDID:                make(map[string]*Account),
+		byHandle:             make(map[string]*Account),
+		updated:              make(chan struct{}),
+		done:                 make(chan struct{}),
+	}
+	n.Server = httptest.NewServer(n.handler())
+	return n
+}
+
+func (n *Network) Close() {
+	close(n.done)
+	n.Server.Close()
+}
+
+// URL is the base URL of the fake PDS, AppView and PLC directory.
+func (n *Network) URL() string {
+	return n.Server.URL
+}
+
+// RelayURL is the websocket base URL of the fake relay (for --relay-host).
+func (n *Network) RelayURL() string {
+	return "ws" + strings.TrimPrefix(n.Server.URL, "http")
+}
+
+// SubscribeReposURL is the full websocket URL of the fake firehose, as used by
+// stream.Stream.
+func (n *Network) SubscribeReposURL() *url.URL {
+	u, _ := url.Parse(n.RelayURL() + "/xrpc/com.atproto.sync.subscribeRepos")
+	return u
+}
+
+// Configure points a hydrator at the fake network.
+func (n *Network) Configure(h *hydrator.Hydrator) {
+	h.Client.Host = n.URL()
+	h.IdentityDirectory = n
+	h.PLCHost = n.URL()
+	h.PLCClient = n.Server.Client()
+}
+
+// CreateAccount creates an account with an empty repo. Its DID is derived from
+// the handle, so fixtures are stable from run to run.
+func (n *Network) CreateAccount(ctx context.Context, handle string) (*Account, error) {
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(handle))
+	did := "did:plc:" + strings.ToLower(base32.StdEncoding.EncodeToString(hash[:]))[:24]
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	account := &Account{
+		DID:       did,
+		Handle:    handle,
+		Password:  DefaultPassword,
+		Key:       key,
+		CreatedAt: time.Now().UTC(),
+		repo:      repo.NewRepo(ctx, did, bs),
+		bs:        bs,
+	}
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if _, exists := n.byHandle[handle]; exists {
+		return nil, fmt.Errorf("account %s already exists", handle)
+	}
+
+	// Commit the empty repo, so that it can be fetched right away (but don't
+	// announce it on the firehose, since there are no ops)
+	if _, _, err := n.commit(ctx, account); err != nil {
+		return nil, err
+	}
+
+	n.accounts = append(n.accounts, account)
+	n.byDID[did] = account
+	n.byHandle[handle] = account
+
+	return account, nil
+}
+
+// CreateRecord adds a record with a fresh TID to an account's repo and
+// announces the commit on the firehose. It returns the record's path (i.e.,
+// collection/rkey) and CID.
+func (n *Network) CreateRecord(ctx context.Context, account *Account, collection string, rec repo.CborMarshaler) (string, cid.Cid, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	c, rkey, err := account.repo.CreateRecord(ctx, collection, rec)
+	if err != nil {
+		return "", cid.Undef, err
+	}
+
+	path := collection + "/" + rkey
+	link := lexutil.LexLink(c)
+	err = n.commitAndAnnounce(ctx, account, &comatproto.SyncSubscribeRepos_RepoOp{
+		Action: "create",
+		Path:   path,
+		Cid:    &link,
+	})
+
+	return path, c, err
+}
+
+// PutRecord creates or updates the record at path (e.g.,
+// "app.bsky.actor.profile/self") and announces the commit on the firehose.
+func (n *Network) PutRecord(ctx context.Context, account *Account, path string, rec repo.CborMarshaler) (cid.Cid, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	action := "create"
+	var c cid.Cid
+	var err error
+	if _, _, getErr := account.repo.GetRecord(ctx, path); getErr == nil {
+		action = "update"
+		c, err = account.repo.UpdateRecord(ctx, path, rec)
+	} else {
+		c, err = account.repo.PutRecord(ctx, path, rec)
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	link := lexutil.LexLink(c)
+	err = n.commitAndAnnounce(ctx, account, &comatproto.SyncSubscribeRepos_RepoOp{
+		Action: action,
+		Path:   path,
+		Cid:    &link,
+	})
+
+	return c, err
+}
+
+// DeleteRecord removes a record and announces the commit on the firehose.
+func (n *Network) DeleteRecord(ctx context.Context, account *Account, path string) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if err := account.repo.DeleteRecord(ctx, path); err != nil {
+		return err
+	}
+
+	return n.commitAndAnnounce(ctx, account, &comatproto.SyncSubscribeRepos_RepoOp{
+		Action: "delete",
+		Path:   path,
+	})
+}
+
+// Events returns every event announced on the firehose so far, in seq order.
+func (n *Network) Events() []*events.XRPCStreamEvent {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return append([]*events.XRPCStreamEvent{}, n.events...)
+}
+
+// RepoCAR returns an account's full repo, as served by getRepo.
+func (n *Network) RepoCAR(ctx context.Context, did string) ([]byte, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	account, ok := n.byDID[did]
+	if !ok {
+		return nil, fmt.Errorf("no such repo: %s", did)
+	}
+
+	return account.car(ctx)
+}
+
+// WriteCAR writes an account's full repo to a .car file (e.g., for the hydrate
+// command).
+func (n *Network) WriteCAR(ctx context.Context, did string, path string) error {
+	data, err := n.RepoCAR(ctx, did)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Signs a new commit for the account; callers must hold n.lk.
+func (n *Network) commit(ctx context.Context, account *Account) (prevRev string, blocks []byte, err error) {
+	prevRev = account.rev
+
+	root, rev, err := account.repo.Commit(ctx, func(ctx context.Context, did string, data []byte) ([]byte, error) {
+		return account.Key.HashAndSign(data)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	account.head = root
+	account.rev = rev
+
+	blocks, err = account.car(ctx)
+	return prevRev, blocks, err
+}
+
+// Commits and announces a single op; callers must hold n.lk.
+func (n *Network) commitAndAnnounce(ctx context.Context, account *Account, op *comatproto.SyncSubscribeRepos_RepoOp) error {
+	prevRev, blocks, err := n.commit(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	// For simplicity, each event carries the whole repo rather than just the
+	// blocks that changed; consumers don't mind the extra blocks
+	evt := &comatproto.SyncSubscribeRepos_Commit{
+		Blobs:  []lexutil.LexLink{},
+		Blocks: blocks,
+		Commit: lexutil.LexLink(account.head),
+		Ops:    []*comatproto.SyncSubscribeRepos_RepoOp{op},
+		Repo:   account.DID,
+		Rev:    account.rev,
+		Seq:    int64(len(n.events) + 1),
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if prevRev != "" {
+		evt.Since = &prevRev
+	}
+
+	n.events = append(n.events, &events.XRPCStreamEvent{RepoCommit: evt})
+
+	// Wake up everyone waiting on the firehose
+	close(n.updated)
+	n.updated = make(chan struct{})
+
+	return nil
+}
+
+// Writes every block in the account's blockstore as a CAR rooted at its head.
+func (a *Account) car(ctx context.Context) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{a.head}, Version: 1}, buf); err != nil {
+		return nil, err
+	}
+
+	keys, err := a.bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for c := range keys {
+		blk, err := a.bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := carutil.LdWrite(buf, c.Bytes(), blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// The DID document the fake PLC directory serves for an account.
+func (n *Network) didDocument(account *Account) identity.DIDDocument {
+	pub, _ := account.Key.PublicKey()
+	return identity.DIDDocument{
+		DID:         syntax.DID(account.DID),
+		AlsoKnownAs: []string{"at://" + account.Handle},
+		VerificationMethod: []identity.DocVerificationMethod{{
+			ID:                 account.DID + "#atproto",
+			Type:               "Multikey",
+			Controller:         account.DID,
+			PublicKeyMultibase: pub.Multibase(),
+		}},
+		Service: []identity.DocService{{
+			ID:              "#atproto_pds",
+			Type:            "AtprotoPersonalDataServer",
+			ServiceEndpoint: n.URL(),
+		}},
+	}
+}
+
+// The Network is also an identity directory, so that it can stand in for the
+// real one without any DNS or HTTP handle resolution.
+
+func (n *Network) LookupHandle(ctx context.Context, h syntax.Handle) (*identity.Identity, error) {
+	n.lk.Lock()
+	account, ok := n.byHandle[h.Normalize().String()]
+	n.lk.Unlock()
+	if !ok {
+		return nil, identity.ErrHandleNotFound
+	}
+	ident := n.identity(account)
+	return &ident, nil
+}
+
+func (n *Network) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	n.lk.Lock()
+	account, ok := n.byDID[did.String()]
+	n.lk.Unlock()
+	if !ok {
+		return nil, identity.ErrDIDNotFound
+	}
+	ident := n.identity(account)
+	return &ident, nil
+}
+
+func (n *Network) Lookup(ctx context.Context, a syntax.AtIdentifier) (*identity.Identity, error) {
+	if handle, err := a.AsHandle(); err == nil {
+		return n.LookupHandle(ctx, handle)
+	}
+	did, err := a.AsDID()
+	if err != nil {
+		return nil, err
+	}
+	return n.LookupDID(ctx, did)
+}
+
+func (n *Network) Purge(ctx context.Context, a syntax.AtIdentifier) error {
+	return nil
+}
+
+func (n *Network) identity(account *Account) identity.Identity {
+	doc := n.didDocument(account)
+	ident := identity.ParseIdentity(&doc)
+	ident.Handle = syntax.Handle(account.Handle)
+	return ident
+}
@@ -0,0 +1,450 @@
+package testsupport
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/hydrator"
+)
+
+func (n *Network) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Relay
+	mux.HandleFunc("/xrpc/com.atproto.sync.subscribeRepos", n.handleSubscribeRepos)
+	mux.HandleFunc("/xrpc/com.atproto.sync.listRepos", n.handleListRepos)
+	mux.HandleFunc("/xrpc/com.atproto.sync.getRepo", n.handleGetRepo)
+
+	// PDS
+	mux.HandleFunc("/xrpc/com.atproto.server.createSession", n.handleCreateSession)
+	mux.HandleFunc("/xrpc/com.atproto.server.refreshSession", n.handleRefreshSession)
+
+	// AppView
+	mux.HandleFunc("/xrpc/app.bsky.feed.getPosts", n.handleGetPosts)
+	mux.HandleFunc("/xrpc/app.bsky.actor.getProfile", n.handleGetProfile)
+
+	// PLC directory (i.e., /<did> and /<did>/log/audit)
+	mux.HandleFunc("/", n.handlePLC)
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnf("Failed to write fake response: %+v", err)
+	}
+}
+
+// Errors are returned the way XRPC services return them, so that clients see
+// the same *xrpc.Error they'd get from the real thing.
+func writeXRPCError(w http.ResponseWriter, status int, name string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": name, "message": message})
+}
+
+func (n *Network) account(identifier string) (*Account, bool) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if account, ok := n.byDID[identifier]; ok {
+		return account, true
+	}
+	account, ok := n.byHandle[strings.ToLower(identifier)]
+	return account, ok
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Serves every event after the cursor, then keeps the connection open and
+// serves new events as they're announced.
+func (n *Network) handleSubscribeRepos(w http.ResponseWriter, r *http.Request) {
+	var next int
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		seq, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			writeXRPCError(w, http.StatusBadRequest, "InvalidRequest", "invalid cursor")
+			return
+		}
+		next = int(seq) // events[i] has seq i+1, so this is the first event after the cursor
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("Failed to upgrade fake firehose connection: %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Notice when the client goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		n.lk.Lock()
+		if next > len(n.events) {
+			next = len(n.events)
+		}
+		pending := n.events[next:]
+		updated := n.updated
+		n.lk.Unlock()
+
+		for _, evt := range pending {
+			wr, err := conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return
+			}
+			if err := evt.Serialize(wr); err != nil {
+				log.Warnf("Failed to serialize fake event: %+v", err)
+				return
+			}
+			if err := wr.Close(); err != nil {
+				return
+			}
+			next++
+		}
+
+		select {
+		case <-updated:
+		case <-closed:
+			return
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Network) handleListRepos(w http.ResponseWriter, r *http.Request) {
+	limit := 500
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	start := 0
+	if c, err := strconv.Atoi(r.URL.Query().Get("cursor")); err == nil {
+		start = c
+	}
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	out := comatproto.SyncListRepos_Output{Repos: []*comatproto.SyncListRepos_Repo{}}
+	end := start + limit
+	if end > len(n.accounts) {
+		end = len(n.accounts)
+	}
+	for i := start; i < end; i++ {
+		account := n.accounts[i]
+		out.Repos = append(out.Repos, &comatproto.SyncListRepos_Repo{
+			Did:  account.DID,
+			Head: account.head.String(),
+			Rev:  account.rev,
+		})
+	}
+	if end < len(n.accounts) {
+		cursor := strconv.Itoa(end)
+		out.Cursor = &cursor
+	}
+
+	writeJSON(w, out)
+}
+
+func (n *Network) handleGetRepo(w http.ResponseWriter, r *http.Request) {
+	data, err := n.RepoCAR(r.Context(), r.URL.Query().Get("did"))
+	if err != nil {
+		writeXRPCError(w, http.StatusBadRequest, "RepoNotFound", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Write(data)
+}
+
+func (n *Network) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var input comatproto.ServerCreateSession_Input
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeXRPCError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+
+	account, ok := n.account(input.Identifier)
+	if !ok || input.Password != account.Password {
+		writeXRPCError(w, http.StatusUnauthorized, "AuthenticationRequired", "Invalid identifier or password")
+		return
+	}
+
+	writeJSON(w, comatproto.ServerCreateSession_Output{
+		AccessJwt:  n.token(account, "com.atproto.access", n.AccessTokenLifetime),
+		RefreshJwt: n.token(account, "com.atproto.refresh", n.RefreshTokenLifetime),
+		Did:        account.DID,
+		Handle:     account.Handle,
+	})
+}
+
+func (n *Network) handleRefreshSession(w http.ResponseWriter, r *http.Request) {
+	claims, ok := parseToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	account, found := n.account(claims.Sub)
+	if !ok || !found || claims.Scope != "com.atproto.refresh" {
+		writeXRPCError(w, http.StatusBadRequest, "InvalidToken", "Token could not be verified")
+		return
+	}
+	if time.Now().Unix() >= claims.Exp {
+		writeXRPCError(w, http.StatusBadRequest, "ExpiredToken", "Token has expired")
+		return
+	}
+
+	writeJSON(w, comatproto.ServerRefreshSession_Output{
+		AccessJwt:  n.token(account, "com.atproto.access", n.AccessTokenLifetime),
+		RefreshJwt: n.token(account, "com.atproto.refresh", n.RefreshTokenLifetime),
+		Did:        account.DID,
+		Handle:     account.Handle,
+	})
+}
+
+type tokenClaims struct {
+	Scope string `json:"scope"`
+	Sub   string `json:"sub"`
+	Exp   int64  `json:"exp"`
+	Jti   string `json:"jti"`
+}
+
+// token makes a JWT-shaped session token. It isn't signed, since nothing checks
+// signatures, but it has the claims that clients read (e.g., its expiry).
+func (n *Network) token(account *Account, scope string, lifetime time.Duration) string {
+	claims, _ := json.Marshal(tokenClaims{
+		Scope: scope,
+		Sub:   account.DID,
+		Exp:   time.Now().Add(lifetime).Unix(),
+		Jti:   strconv.FormatInt(time.Now().UnixNano(), 36),
+	})
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(claims) + ".unsigned"
+}
+
+func parseToken(token string) (tokenClaims, bool) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, false
+	}
+	return claims, json.Unmarshal(payload, &claims) == nil
+}
+
+func (n *Network) handleGetPosts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	out := bsky.FeedGetPosts_Output{Posts: []*bsky.FeedDefs_PostView{}}
+
+	// Like the real AppView, posts that don't exist are left out
+	for _, uri := range r.URL.Query()["uris"] {
+		aturi, err := syntax.ParseATURI(uri)
+		if err != nil {
+			writeXRPCError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+			return
+		}
+
+		account, ok := n.account(aturi.Authority().String())
+		if !ok {
+			continue
+		}
+
+		n.lk.Lock()
+		c, rec, err := account.repo.GetRecord(ctx, aturi.Collection().String()+"/"+aturi.RecordKey().String())
+		n.lk.Unlock()
+		if err != nil {
+			continue
+		}
+
+		likes := n.countSubjects(ctx, "app.bsky.feed.like", uri)
+		reposts := n.countSubjects(ctx, "app.bsky.feed.repost", uri)
+		out.Posts = append(out.Posts, &bsky.FeedDefs_PostView{
+			Uri:         "at://" + account.DID + "/" + aturi.Collection().String() + "/" + aturi.RecordKey().String(),
+			Cid:         c.String(),
+			Author:      n.profileViewBasic(ctx, account),
+			Record:      &lexutil.LexiconTypeDecoder{Val: rec},
+			IndexedAt:   account.CreatedAt.Format("2006-01-02T15:04:05.000Z"),
+			LikeCount:   &likes,
+			RepostCount: &reposts,
+		})
+	}
+
+	writeJSON(w, out)
+}
+
+func (n *Network) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	account, ok := n.account(r.URL.Query().Get("actor"))
+	if !ok {
+		writeXRPCError(w, http.StatusBadRequest, "InvalidRequest", "Profile not found")
+		return
+	}
+
+	basic := n.profileViewBasic(ctx, account)
+	posts := n.countRecords(ctx, account, "app.bsky.feed.post")
+	follows := n.countRecords(ctx, account, "app.bsky.graph.follow")
+	followers := n.countSubjects(ctx, "app.bsky.graph.follow", account.DID)
+	indexedAt := account.CreatedAt.Format("2006-01-02T15:04:05.000Z")
+
+	profile := bsky.ActorDefs_ProfileViewDetailed{
+		Did:            account.DID,
+		Handle:         account.Handle,
+		DisplayName:    basic.DisplayName,
+		Avatar:         basic.Avatar,
+		PostsCount:     &posts,
+		FollowsCount:   &follows,
+		FollowersCount: &followers,
+		IndexedAt:      &indexedAt,
+	}
+	if self := n.profileRecord(ctx, account); self != nil {
+		profile.Description = self.Description
+	}
+
+	writeJSON(w, profile)
+}
+
+func (n *Network) handlePLC(w http.ResponseWriter, r *http.Request) {
+	did, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	account, ok := n.account(did)
+	if !ok || !strings.HasPrefix(did, "did:plc:") {
+		http.Error(w, fmt.Sprintf("DID not registered: %s", did), http.StatusNotFound)
+		return
+	}
+
+	switch rest {
+	case "":
+		writeJSON(w, n.didDocument(account))
+	case "log/audit":
+		writeJSON(w, n.auditLog(account))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Every fake account was created with a single PLC operation, and never changed.
+func (n *Network) auditLog(account *Account) []hydrator.PLCAuditEntry {
+	doc := n.didDocument(account)
+	pub, _ := account.Key.PublicKey()
+	op := hydrator.PLCOperation{
+		Type:                "plc_operation",
+		AlsoKnownAs:         doc.AlsoKnownAs,
+		RotationKeys:        []string{pub.DIDKey()},
+		VerificationMethods: map[string]string{"atproto": pub.DIDKey()},
+		Services: map[string]hydrator.PLCService{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", Endpoint: n.URL()},
+		},
+	}
+
+	// Operations are addressed by the CID of their (signed) DAG-CBOR encoding;
+	// the hash of the JSON is close enough for a fake
+	encoded, _ := json.Marshal(op)
+	opCid, _ := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: 0x12 /* sha2-256 */, MhLength: -1}.Sum(encoded)
+
+	return []hydrator.PLCAuditEntry{{
+		DID:       account.DID,
+		CID:       opCid.String(),
+		CreatedAt: account.CreatedAt.Format("2006-01-02T15:04:05.000Z"),
+		Operation: op,
+	}}
+}
+
+func (n *Network) profileRecord(ctx context.Context, account *Account) *bsky.ActorProfile {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	_, rec, err := account.repo.GetRecord(ctx, "app.bsky.actor.profile/self")
+	if err != nil {
+		return nil
+	}
+	profile, _ := rec.(*bsky.ActorProfile)
+	return profile
+}
+
+func (n *Network) profileViewBasic(ctx context.Context, account *Account) *bsky.ActorDefs_ProfileViewBasic {
+	view := &bsky.ActorDefs_ProfileViewBasic{
+		Did:    account.DID,
+		Handle: account.Handle,
+	}
+	if self := n.profileRecord(ctx, account); self != nil {
+		view.DisplayName = self.DisplayName
+	}
+	return view
+}
+
+func (n *Network) countRecords(ctx context.Context, account *Account, collection string) int64 {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	var count int64
+	account.repo.ForEach(ctx, collection, func(k string, v cid.Cid) error {
+		if !strings.HasPrefix(k, collection+"/") {
+			return repo.ErrDoneIterating
+		}
+		count++
+		return nil
+	})
+	return count
+}
+
+// Counts the likes, reposts or follows (across every account) whose subject is
+// the given URI or DID.
+func (n *Network) countSubjects(ctx context.Context, collection string, subject string) int64 {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	var count int64
+	for _, account := range n.accounts {
+		account.repo.ForEach(ctx, collection, func(k string, v cid.Cid) error {
+			if !strings.HasPrefix(k, collection+"/") {
+				return repo.ErrDoneIterating
+			}
+			_, rec, err := account.repo.GetRecord(ctx, k)
+			if err != nil {
+				return nil
+			}
+			switch rec := rec.(type) {
+			case *bsky.FeedLike:
+				if rec.Subject != nil && rec.Subject.Uri == subject {
+					count++
+				}
+			case *bsky.FeedRepost:
+				if rec.Subject != nil && rec.Subject.Uri == subject {
+					count++
+				}
+			case *bsky.GraphFollow:
+				if rec.Subject == subject {
+					count++
+				}
+			}
+			return nil
+		})
+	}
+	return count
+}
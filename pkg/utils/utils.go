@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -9,8 +10,11 @@ import (
 	"os"
 	"time"
 
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/hashicorp/go-retryablehttp"
 	log "github.com/sirupsen/logrus"
+	"github.com/stanfordio/skyfall/pkg/breaker"
+	"github.com/stanfordio/skyfall/pkg/hostlimit"
 )
 
 // From https://stackoverflow.com/questions/17863821/how-to-read-last-lines-from-a-big-file-with-go-every-10-secs
@@ -48,11 +52,22 @@ func GetLastLine(filepath string) (string, error) {
 }
 
 func RetryingHTTPClient() *http.Client {
+	return RetryingHTTPClientWith(nil)
+}
+
+// RetryingHTTPClientWith is RetryingHTTPClient with each attempt's transport
+// wrapped by wrap (e.g., to authenticate it), so that retries can go out
+// differently than the first attempt did.
+func RetryingHTTPClientWith(wrap func(http.RoundTripper) http.RoundTripper) *http.Client {
 	retryClient := retryablehttp.NewClient()
 	retryClient.RetryMax = 5
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 5 * time.Minute
 	retryClient.CheckRetry = XRPCRetryPolicy
+	retryClient.HTTPClient.Transport = hostTransport(retryClient.HTTPClient.Transport)
+	if wrap != nil {
+		retryClient.HTTPClient.Transport = wrap(retryClient.HTTPClient.Transport)
+	}
 	client := retryClient.StandardClient()
 	client.Timeout = 10 * time.Second
 
@@ -65,13 +80,35 @@ func RetryingHTTPClientExcept429() *http.Client {
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 120 * time.Minute
 	retryClient.CheckRetry = XRPCRetryPolicyExcept429
+	retryClient.HTTPClient.Transport = hostTransport(retryClient.HTTPClient.Transport)
 	client := retryClient.StandardClient()
 	client.Timeout = 30 * time.Second
 
 	return client
 }
 
+// RateLimitedHTTPClient makes plain requests (no retries or timeout, e.g., for
+// downloading whole repos) that still respect per-host rate limits and circuit
+// breakers.
+func RateLimitedHTTPClient() *http.Client {
+	return &http.Client{Transport: hostTransport(nil)}
+}
+
+// hostTransport wraps a transport with the shared per-host circuit breakers and
+// rate limits. The breakers go first, so that requests to open hosts fail
+// without using up any of the hosts' budgets (and requests that time out while
+// waiting for a budget don't count against the host).
+func hostTransport(next http.RoundTripper) http.RoundTripper {
+	return breaker.Shared.Transport(hostlimit.Shared.Transport(next))
+}
+
 func XRPCRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	// Hosts with open circuit breakers fail fast until their cooldown is over,
+	// so there's no point retrying
+	if errors.Is(err, breaker.ErrOpen) {
+		return false, err
+	}
+
 	// Do not retry network errors, since these are usually because the PDS is dead
 	if err != nil {
 		if _, ok := err.(*net.OpError); !ok {
@@ -91,3 +128,30 @@ func XRPCRetryPolicyExcept429(ctx context.Context, resp *http.Response, err erro
 
 	return XRPCRetryPolicy(ctx, resp, err)
 }
+
+// IdentityDirectory is the same as indigo's default identity directory, but
+// resolves did:plc DIDs through the given PLC directory (e.g., a mirror, or a
+// fake one for testing).
+func IdentityDirectory(plcHost string) identity.Directory {
+	base := identity.BaseDirectory{
+		PLCURL: plcHost,
+		HTTPClient: http.Client{
+			Timeout: time.Second * 10,
+			Transport: hostTransport(&http.Transport{
+				IdleConnTimeout: time.Millisecond * 1000,
+				MaxIdleConns:    100,
+			}),
+		},
+		Resolver: net.Resolver{
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: time.Second * 3}
+				return d.DialContext(ctx, network, address)
+			},
+		},
+		TryAuthoritativeDNS: true,
+		// The primary Bluesky PDS instance only supports HTTP handle resolution
+		SkipDNSDomainSuffixes: []string{".bsky.social"},
+	}
+	cached := identity.NewCacheDirectory(&base, 250_000, time.Hour*24, time.Minute*2, time.Minute*5)
+	return &cached
+}